@@ -1,16 +1,27 @@
 package agent
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"go.uber.org/zap"
-	"hash/fnv"
+	"in-cluster/internal/config"
 	"in-cluster/pkg/kube_api"
-	"math/rand"
+	"net/http"
 	"os"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/oklog/ulid/v2"
+	"sigs.k8s.io/yaml"
 
 	"github.com/open-telemetry/opamp-go/client"
 	"github.com/open-telemetry/opamp-go/client/types"
@@ -39,6 +50,8 @@ service:
 type Agent struct {
 	logger *zap.SugaredLogger
 
+	cfg *config.Config
+
 	agentType    string
 	agentVersion string
 
@@ -46,51 +59,204 @@ type Agent struct {
 
 	agentDescription *protobufs.AgentDescription
 
+	clientMu    sync.RWMutex
 	opampClient client.OpAMPClient
+	transport   config.Transport
+
+	// switchMu serializes transport switches
+	switchMu        sync.Mutex
+	switching       int32
+	connectFailures int32
+
+	tlsConfig *tls.Config
 
 	remoteConfigStatus *protobufs.RemoteConfigStatus
 
 	k8sAPIClient kube_api.K8sAPIClient
 
-	//hash to stop infinite loop
-	hash map[uint64]struct{}
+	// ledger of applied config files, stops re-applying unchanged ones
+	ledger *ledger
+
+	// plans previews the config files of the last sync that ran as a dry run
+	plansMu sync.RWMutex
+	plans   map[string][]kube_api.Change
+
+	// remoteConfigs hands the latest remote config to the worker applying them
+	// one at a time, outside the client's message loop
+	remoteConfigs chan *protobufs.AgentRemoteConfig
+	stopWorker    context.CancelFunc
+	// dryRunHash is the last remote config that was only previewed, it is
+	// only used by the worker
+	dryRunHash []byte
+
+	// health of the applied objects as last reported by the watcher
+	startedAt time.Time
+	healthMu  sync.RWMutex
+	health    []kube_api.ObjectHealth
+	// healthSentAt is when the effective config last went out for a health
+	// change, healthScheduled is set while a later one is pending
+	healthSentAt    time.Time
+	healthScheduled bool
+
+	// ctx is cancelled by stop when the client and the watchers stop, running
+	// counts the goroutines started for them. A restart replaces both once the
+	// goroutines of the previous run returned.
+	runMu   sync.RWMutex
+	ctx     context.Context
+	stop    context.CancelFunc
+	running sync.WaitGroup
+	// restartMu serializes restarts
+	restartMu sync.Mutex
 }
 
-func NewAgent(logger *zap.SugaredLogger, agentType string, agentVersion string) *Agent {
+// NewAgent creates the agent and starts it, the error tells why it could not
+func NewAgent(logger *zap.SugaredLogger, cfg *config.Config) (*Agent, error) {
 	agent := &Agent{
 		logger:       logger,
-		agentType:    agentType,
-		agentVersion: agentVersion,
-		k8sAPIClient: kube_api.NewClient(logger),
-		hash:         make(map[uint64]struct{}),
+		cfg:          cfg,
+		agentType:    cfg.AgentType,
+		agentVersion: cfg.AgentVersion,
+		startedAt:    time.Now(),
+		// Holds at most the one remote config waiting for the worker
+		remoteConfigs: make(chan *protobufs.AgentRemoteConfig, 1),
+		k8sAPIClient: kube_api.NewClient(logger, kube_api.Options{
+			Namespace:          cfg.Namespace,
+			AllowedNamespaces:  cfg.AllowedNamespaces,
+			AllowClusterScoped: cfg.AllowClusterScoped,
+			ApplyMode:          kube_api.ApplyMode(cfg.Apply.Mode),
+			FieldManager:       cfg.Apply.FieldManager,
+			ForceConflicts:     cfg.Apply.ForceConflicts,
+			Atomic:             cfg.Apply.Atomic,
+			DryRun:             cfg.Apply.DryRun,
+			LegacyPayloads:     cfg.Apply.LegacyPayloads,
+		}),
 	}
+	agent.ledger = newLedger(logger,
+		agent.k8sAPIClient.Store(kube_api.SecretStore, cfg.Ledger.Namespace, cfg.Ledger.Name),
+		agent.k8sAPIClient.Store(kube_api.ConfigMapStore, cfg.Ledger.Namespace, cfg.Ledger.Name))
 
-	agent.createAgentIdentity()
+	if err := agent.createAgentIdentity(); err != nil {
+		return nil, fmt.Errorf("cannot create agent identity: %w", err)
+	}
 	agent.logger.Debugf("Agent starting, id=%v, type=%s, version=%s.",
-		agent.instanceId.String(), agentType, agentVersion)
+		agent.instanceId.String(), agent.agentType, agent.agentVersion)
+
+	if err := agent.ledger.load(context.Background()); err != nil {
+		agent.logger.Errorf("Cannot load ledger, config files will be re-applied: %v", err)
+	}
+	agent.k8sAPIClient.Track(agent.ledger.objects())
+	agent.restoreDesired()
+
+	// The worker outlives restarts of the client, an apply is never cut short by one
+	var workerCtx context.Context
+	workerCtx, agent.stopWorker = context.WithCancel(context.Background())
+	go agent.applyRemoteConfigs(workerCtx)
 
 	//agent.loadLocalConfig()
 	if err := agent.start(); err != nil {
-		agent.logger.Errorf("Cannot start OpAMP client: %v", err)
-		return nil
+		agent.stopRunning()
+		agent.stopWorker()
+		return nil, fmt.Errorf("cannot start OpAMP client: %w", err)
 	}
 
-	return agent
+	return agent, nil
 }
 
 func (agent *Agent) start() error {
-	agent.opampClient = client.NewHTTP(agent.logger)
+	ctx, stop := context.WithCancel(context.Background())
+	agent.runMu.Lock()
+	agent.ctx, agent.stop = ctx, stop
+	agent.runMu.Unlock()
+
+	if err := agent.setupTLS(); err != nil {
+		return err
+	}
+
+	if err := agent.startClient(agent.cfg.Server.Transport); err != nil {
+		return err
+	}
+
+	if agent.cfg.HeartbeatInterval > 0 {
+		agent.goRun(func(ctx context.Context) {
+			agent.heartbeat(ctx, agent.cfg.HeartbeatInterval)
+		})
+	}
+
+	if agent.cfg.Drift.Interval > 0 {
+		policy := kube_api.DriftPolicy(agent.cfg.Drift.Policy)
+		// A dry run agent must not change the cluster, drift is only reported.
+		if agent.cfg.Apply.DryRun && policy == kube_api.DriftHeal {
+			policy = kube_api.DriftReport
+		}
+		agent.goRun(func(ctx context.Context) {
+			agent.k8sAPIClient.Reconcile(ctx, kube_api.ReconcileOptions{
+				Interval: agent.cfg.Drift.Interval,
+				Policy:   policy,
+			}, agent.onDrift)
+		})
+	}
+
+	if agent.cfg.Health.Interval > 0 {
+		agent.goRun(func(ctx context.Context) {
+			agent.k8sAPIClient.WatchHealth(ctx, agent.cfg.Health.Interval, agent.onHealth)
+		})
+	}
 
-	settings := types.StartSettings{
-		OpAMPServerURL: "http://host.minikube.internal:3000/v1/opamp",
+	return nil
+}
+
+// context returns the context of the current run
+func (agent *Agent) context() context.Context {
+	agent.runMu.RLock()
+	defer agent.runMu.RUnlock()
+	return agent.ctx
+}
+
+// goRun runs f in a goroutine with the context of the current run and reports
+// whether it did, nothing runs once the run was stopped
+func (agent *Agent) goRun(f func(ctx context.Context)) bool {
+	agent.runMu.RLock()
+	defer agent.runMu.RUnlock()
+	ctx := agent.ctx
+	if ctx.Err() != nil {
+		return false
+	}
+	agent.running.Add(1)
+	go func() {
+		defer agent.running.Done()
+		f(ctx)
+	}()
+	return true
+}
+
+// stopRunning cancels the current run and waits for its goroutines
+func (agent *Agent) stopRunning() {
+	agent.runMu.Lock()
+	stop := agent.stop
+	agent.runMu.Unlock()
+	if stop != nil {
+		stop()
+	}
+	agent.running.Wait()
+}
+
+func (agent *Agent) startSettings(serverURL string) types.StartSettings {
+	header := http.Header{}
+	for k, v := range agent.cfg.Server.Headers {
+		header.Set(k, v)
+	}
+
+	return types.StartSettings{
+		OpAMPServerURL: serverURL,
+		Header:         header,
+		TLSConfig:      agent.tlsConfig,
 		InstanceUid:    agent.instanceId.String(),
 		Callbacks: types.CallbacksStruct{
 			OnConnectFunc: func() {
 				agent.logger.Debugf("Connected to the server.")
+				atomic.StoreInt32(&agent.connectFailures, 0)
 			},
-			OnConnectFailedFunc: func(err error) {
-				agent.logger.Errorf("Failed to connect to the server: %v", err)
-			},
+			OnConnectFailedFunc: agent.onConnectFailed,
 			OnErrorFunc: func(err *protobufs.ServerErrorResponse) {
 				agent.logger.Errorf("Server returned an error response: %v", err.ErrorMessage)
 			},
@@ -98,33 +264,56 @@ func (agent *Agent) start() error {
 				agent.remoteConfigStatus = status
 			},
 			GetEffectiveConfigFunc: func(ctx context.Context) (*protobufs.EffectiveConfig, error) {
-				return agent.composeEffectiveConfig(), nil
+				return agent.composeEffectiveConfig(ctx)
 			},
 			OnMessageFunc: agent.onMessage,
+			OnCommandFunc: agent.onCommand,
 		},
 		RemoteConfigStatus: agent.remoteConfigStatus,
+		Capabilities:       agent.capabilities(),
 	}
-	err := agent.opampClient.SetAgentDescription(agent.agentDescription)
-	if err != nil {
-		return err
-	}
-
-	agent.logger.Debugf("Starting OpAMP client...")
+}
 
-	err = agent.opampClient.Start(context.Background(), settings)
-	if err != nil {
-		return err
+// onDrift logs the drift and sends the effective config, which shows the
+// server the live state of the object
+func (agent *Agent) onDrift(drift kube_api.Drift) {
+	switch {
+	case drift.Err != nil:
+		agent.logger.Errorf("Cannot heal drift, %s: %v", drift, drift.Err)
+	case drift.Healed:
+		agent.logger.Infof("Healed drift, %s", drift)
+	default:
+		agent.logger.Infof("Detected drift, %s", drift)
 	}
+	if err := agent.updateEffectiveConfig(agent.context()); err != nil {
+		agent.logger.Errorf("Cannot report drift: %v", err)
+	}
+}
 
-	agent.logger.Debugf("OpAMP Client started.")
-
-	return nil
+// heartbeat periodically re-sends the agent description, which makes the client
+// report its status to the server even when nothing has changed
+func (agent *Agent) heartbeat(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := agent.currentClient().SetAgentDescription(agent.agentDescription); err != nil {
+				agent.logger.Errorf("Cannot send heartbeat: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
-func (agent *Agent) createAgentIdentity() {
+func (agent *Agent) createAgentIdentity() error {
 	// Generate instance id.
-	entropy := ulid.Monotonic(rand.New(rand.NewSource(0)), 0)
-	agent.instanceId = ulid.MustNew(ulid.Timestamp(time.Now()), entropy)
+	instanceId, err := agent.loadInstanceId(context.Background())
+	if err != nil {
+		return err
+	}
+	agent.instanceId = instanceId
 
 	hostname, _ := os.Hostname()
 
@@ -163,6 +352,7 @@ func (agent *Agent) createAgentIdentity() {
 			},
 		},
 	}
+	return nil
 }
 
 func (agent *Agent) updateAgentIdentity(instanceId ulid.ULID) {
@@ -170,7 +360,9 @@ func (agent *Agent) updateAgentIdentity(instanceId ulid.ULID) {
 		agent.instanceId.String(),
 		instanceId.String())
 	agent.instanceId = instanceId
-
+	if err := agent.persistInstanceId(context.Background(), instanceId); err != nil {
+		agent.logger.Errorf("Cannot persist new instance uid: %v", err)
+	}
 }
 
 /*
@@ -186,16 +378,52 @@ func (agent *Agent) loadLocalConfig() {
 	agent.effectiveConfig = string(effectiveConfigBytes)
 }
 */
-func (agent *Agent) composeEffectiveConfig() *protobufs.EffectiveConfig {
+// composeEffectiveConfig reports the live state of every object the agent
+// applied, keyed by group/version/resource/namespace/name
+func (agent *Agent) composeEffectiveConfig(ctx context.Context) (*protobufs.EffectiveConfig, error) {
+	objects, err := agent.k8sAPIClient.EffectiveConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	configMap := make(map[string]*protobufs.AgentConfigFile, len(objects))
+	for key, body := range objects {
+		configMap[key] = &protobufs.AgentConfigFile{
+			Body:        body,
+			ContentType: "application/yaml",
+		}
+	}
+	agent.plansMu.RLock()
+	defer agent.plansMu.RUnlock()
+	for name, changes := range agent.plans {
+		body, err := yaml.Marshal(changes)
+		if err != nil {
+			return nil, err
+		}
+		configMap[dryRunPrefix+name] = &protobufs.AgentConfigFile{
+			Body:        body,
+			ContentType: "application/yaml",
+		}
+	}
+	if health := agent.healthReport(); health != nil {
+		body, err := yaml.Marshal(health)
+		if err != nil {
+			return nil, err
+		}
+		configMap[healthKey] = &protobufs.AgentConfigFile{
+			Body:        body,
+			ContentType: "application/yaml",
+		}
+	}
 	return &protobufs.EffectiveConfig{
 		ConfigMap: &protobufs.AgentConfigMap{
-			ConfigMap: map[string]*protobufs.AgentConfigFile{
-				"": {Body: []byte{}},
-			},
+			ConfigMap: configMap,
 		},
-	}
+	}, nil
 }
 
+// dryRunPrefix keys the previews of dry run config files in the effective config
+const dryRunPrefix = "dry-run/"
+
 type agentConfigFileItem struct {
 	name string
 	file *protobufs.AgentConfigFile
@@ -287,8 +515,12 @@ func (agent *Agent) applyRemoteConfig(config *protobufs.AgentRemoteConfig) (conf
 */
 func (agent *Agent) Shutdown() {
 	agent.logger.Debugf("Agent shutting down...")
-	if agent.opampClient != nil {
-		_ = agent.opampClient.Stop(context.Background())
+	if agent.stopWorker != nil {
+		agent.stopWorker()
+	}
+	agent.stopRunning()
+	if opampClient := agent.currentClient(); opampClient != nil {
+		_ = opampClient.Stop(context.Background())
 	}
 }
 
@@ -340,49 +572,341 @@ func (agent *Agent) onMessage(ctx context.Context, msg *types.MessageData) {
 }
 */
 func (agent *Agent) onMessage(ctx context.Context, msg *types.MessageData) {
-	var configChanged bool
 	if msg.RemoteConfig != nil {
-		var err error
-		for _, v := range msg.RemoteConfig.Config.ConfigMap {
-			agent.logger.Debugf("Received config: %s", string(v.Body))
-			hash := generateHash(v.Body)
-			if _, ok := agent.hash[hash]; !ok {
-				if err = agent.k8sAPIClient.Orchestrate(v.Body, v.ContentType); err != nil {
-					agent.logger.Errorf("Error: %w", err)
-					agent.opampClient.SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
-						LastRemoteConfigHash: msg.RemoteConfig.ConfigHash,
-						Status:               protobufs.RemoteConfigStatus_FAILED,
-						ErrorMessage:         err.Error(),
-					})
-				}
-				agent.hash[hash] = struct{}{}
-				configChanged = true
-			} else {
-				agent.logger.Debugf("config provided is same as already applied, hence ignoring it")
+		if agent.advertises(protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig) {
+			agent.queueRemoteConfig(msg.RemoteConfig)
+		} else {
+			agent.logger.Debugf("Ignoring remote config, AcceptsRemoteConfig is not advertised.")
+		}
+	}
+
+	if msg.AgentIdentification != nil {
+		newInstanceId, err := ulid.Parse(msg.AgentIdentification.NewInstanceUid)
+		if err != nil {
+			agent.logger.Errorf(err.Error())
+			return
+		}
+		agent.updateAgentIdentity(newInstanceId)
+	}
+}
+
+// queueRemoteConfig hands the remote config to the worker without waiting for
+// it, a config still waiting is superseded by the newer one
+func (agent *Agent) queueRemoteConfig(remoteConfig *protobufs.AgentRemoteConfig) {
+	for {
+		select {
+		case agent.remoteConfigs <- remoteConfig:
+			return
+		default:
+		}
+		select {
+		case stale := <-agent.remoteConfigs:
+			agent.logger.Debugf("Remote config %x is superseded before it was applied", stale.ConfigHash)
+		default:
+		}
+	}
+}
+
+// applyRemoteConfigs applies the queued remote configs one at a time until ctx
+// is done, readiness waits and rollbacks no longer hold up the OpAMP client
+func (agent *Agent) applyRemoteConfigs(ctx context.Context) {
+	for {
+		select {
+		case remoteConfig := <-agent.remoteConfigs:
+			// The server may offer a previewed config again, after a reconnect
+			if agent.dryRunHash != nil && bytes.Equal(remoteConfig.ConfigHash, agent.dryRunHash) {
+				agent.logger.Debugf("Remote config %x was already previewed", remoteConfig.ConfigHash)
+				continue
 			}
+			agent.applyRemoteConfig(ctx, remoteConfig)
+		case <-ctx.Done():
+			return
 		}
-		agent.opampClient.SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
-			LastRemoteConfigHash: msg.RemoteConfig.ConfigHash,
-			Status:               protobufs.RemoteConfigStatus_APPLIED,
+	}
+}
+
+// configFileOutcome is the result of applying a single remote config file
+type configFileOutcome struct {
+	name    string
+	file    *protobufs.AgentConfigFile
+	hash    string
+	skipped bool
+	dryRun  bool
+	changes []kube_api.Change
+	objects []kube_api.ObjectRef
+	err     error
+}
+
+// applyRemoteConfig applies every config file in name order and reports
+// APPLYING while in flight and until the applied workloads are ready, then
+// APPLIED or FAILED with all failed files named.
+// Every attempt is recorded in the ledger, only files whose content changed
+// since they were last applied successfully are applied again. A config with
+// previewed files is reported as a dry run under its own hash and does not
+// remove files from the ledger.
+func (agent *Agent) applyRemoteConfig(ctx context.Context, remoteConfig *protobufs.AgentRemoteConfig) {
+	agent.setRemoteConfigStatus(remoteConfig.ConfigHash, protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLYING, "")
+
+	orderedConfigs := agentConfigFileSlice{}
+	names := make(map[string]struct{})
+	for name, file := range remoteConfig.GetConfig().GetConfigMap() {
+		orderedConfigs = append(orderedConfigs, agentConfigFileItem{
+			name: name,
+			file: file,
 		})
+		names[name] = struct{}{}
+	}
+	sort.Sort(orderedConfigs)
+
+	var (
+		configChanged bool
+		failed        []string
+	)
+	outcomes := make([]configFileOutcome, 0, len(orderedConfigs))
+	for _, item := range orderedConfigs {
+		outcomes = append(outcomes, agent.applyConfigFile(item))
+	}
+	if agent.cfg.Readiness.Timeout > 0 {
+		agent.waitReady(ctx, outcomes)
+	}
+	for _, outcome := range outcomes {
+		if outcome.err == nil && !outcome.skipped && !outcome.dryRun {
+			agent.ledger.markGood(outcome.name, &knownGood{
+				Hash:        outcome.hash,
+				ConfigHash:  hex.EncodeToString(remoteConfig.ConfigHash),
+				ContentType: outcome.file.ContentType,
+				Body:        outcome.file.Body,
+			})
+		}
+	}
+	var dryRuns, skipped int
+	plans := make(map[string][]kube_api.Change)
+	for _, outcome := range outcomes {
+		if outcome.dryRun {
+			dryRuns++
+			plans[outcome.name] = outcome.changes
+			configChanged = true
+		}
+		switch {
+		case outcome.err != nil:
+			agent.logger.Errorf("Cannot apply config file %q: %v", outcome.name, outcome.err)
+			failed = append(failed, fmt.Sprintf("%q: %v", outcome.name, outcome.err))
+		case outcome.skipped:
+			skipped++
+			agent.logger.Debugf("config file %q is same as already applied, hence ignoring it", outcome.name)
+		case outcome.dryRun:
+			agent.logger.Infof("Previewed config file %q without applying it", outcome.name)
+		default:
+			agent.logger.Debugf("Applied config file %q", outcome.name)
+			configChanged = true
+		}
+	}
 
-		if msg.AgentIdentification != nil {
-			newInstanceId, err := ulid.Parse(msg.AgentIdentification.NewInstanceUid)
-			if err != nil {
-				agent.logger.Errorf(err.Error())
+	agent.plansMu.Lock()
+	if len(plans) > 0 || len(agent.plans) > 0 {
+		configChanged = true
+	}
+	agent.plans = plans
+	agent.plansMu.Unlock()
+
+	// A previewed config does not replace the live one, the files it leaves
+	// out are still live and nothing is pruned
+	if dryRuns == 0 {
+		for _, name := range agent.ledger.retain(names) {
+			agent.logger.Debugf("Config file %q is no longer offered, its objects stay in the ledger until pruned", name)
+		}
+		if agent.cfg.Prune.Enabled {
+			if agent.prune(ctx) {
+				configChanged = true
 			}
-			agent.updateAgentIdentity(newInstanceId)
 		}
-		if configChanged {
-			if err = agent.opampClient.UpdateEffectiveConfig(ctx); err != nil {
-				agent.logger.Errorf(err.Error())
+	}
+	if dryRuns == 0 || dryRuns+skipped < len(outcomes) {
+		if err := agent.ledger.save(ctx); err != nil {
+			agent.logger.Errorf("Cannot save ledger: %v", err)
+		}
+	}
+
+	switch {
+	case len(failed) > 0:
+		agent.dryRunHash = nil
+		agent.setRemoteConfigStatus(remoteConfig.ConfigHash, protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED,
+			fmt.Sprintf("failed to apply %d of %d config files: %s",
+				len(failed), len(outcomes), strings.Join(failed, "; ")))
+	case dryRuns > 0:
+		// There is no status for a preview, FAILED keeps the server from
+		// taking the previewed config for the live one
+		agent.dryRunHash = remoteConfig.ConfigHash
+		agent.setRemoteConfigStatus(remoteConfig.ConfigHash, protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED,
+			fmt.Sprintf("dry run, %d of %d config files were previewed without applying them, see %s in the effective config",
+				dryRuns, len(outcomes), dryRunPrefix))
+	default:
+		agent.dryRunHash = nil
+		agent.setRemoteConfigStatus(remoteConfig.ConfigHash, protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED, "")
+	}
+
+	if configChanged {
+		if err := agent.updateEffectiveConfig(ctx); err != nil {
+			agent.logger.Errorf(err.Error())
+		}
+	}
+}
+
+func (agent *Agent) applyConfigFile(item agentConfigFileItem) configFileOutcome {
+	agent.logger.Debugf("Received config: %s", string(item.file.Body))
+	hash := generateHash(item.file.Body)
+	if agent.ledger.unchanged(item.name, hash) {
+		return configFileOutcome{name: item.name, skipped: true}
+	}
+	if reason, ok := agent.ledger.rolledBack(item.name, hash); ok {
+		// The same content would only fail and roll back again
+		return configFileOutcome{name: item.name, skipped: true,
+			err: fmt.Errorf("not applied again until it changes: %s", reason)}
+	}
+	result, err := agent.k8sAPIClient.Orchestrate(item.file.Body, item.file.ContentType)
+	if result.DryRun {
+		return configFileOutcome{name: item.name, file: item.file, hash: hash, dryRun: true,
+			changes: result.Changes, err: err}
+	}
+	objects := result.Objects
+	entry := ledgerEntry{
+		Hash:      hash,
+		AppliedAt: time.Now().UTC(),
+		Objects:   objects,
+		Outcome:   outcomeApplied,
+	}
+	last, ok := agent.ledger.entry(item.name)
+	if ok {
+		entry.Good = last.Good
+	}
+	if err != nil {
+		entry.Outcome = outcomeFailed
+		entry.Error = err.Error()
+		// The file is still desired, keep what it applied before out of prune.
+		if ok {
+			entry.Objects = mergeObjects(entry.Objects, last.Objects)
+		}
+	}
+	agent.ledger.record(item.name, entry)
+	return configFileOutcome{name: item.name, file: item.file, hash: hash, objects: objects, err: err}
+}
+
+// waitReady waits for the objects of the applied files in parallel, a file
+// whose objects do not become ready in time is recorded as failed and rolled
+// back to its last known good content
+func (agent *Agent) waitReady(ctx context.Context, outcomes []configFileOutcome) {
+	opts := kube_api.ReadinessOptions{
+		Timeout:  agent.cfg.Readiness.Timeout,
+		Interval: agent.cfg.Readiness.Interval,
+	}
+	var wg sync.WaitGroup
+	for i := range outcomes {
+		outcome := &outcomes[i]
+		if outcome.err != nil || outcome.skipped || len(outcome.objects) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agent.logger.Debugf("Waiting for the objects of config file %q to become ready", outcome.name)
+			if err := agent.k8sAPIClient.WaitReady(ctx, outcome.objects, opts); err != nil {
+				outcome.err = err
+				agent.ledger.fail(outcome.name, err)
+				if agent.cfg.Readiness.Rollback && errors.Is(err, kube_api.ErrNotReady) {
+					agent.rollback(ctx, outcome, opts)
+				}
 			}
+		}()
+	}
+	wg.Wait()
+}
+
+// restoreDesired rebuilds the desired state of the objects applied before the
+// agent restarted from the content live in the cluster, so their drift is
+// detected and healed before the server sends a new config
+func (agent *Agent) restoreDesired() {
+	for name, good := range agent.ledger.live() {
+		if err := agent.k8sAPIClient.Restore(good.Body, good.ContentType); err != nil {
+			agent.logger.Errorf("Cannot restore the desired state of config file %q: %v", name, err)
+		}
+	}
+}
+
+// rollback applies the last known good content of the file again and notes in
+// the outcome error which remote config is now live
+func (agent *Agent) rollback(ctx context.Context, outcome *configFileOutcome, opts kube_api.ReadinessOptions) {
+	entry, ok := agent.ledger.entry(outcome.name)
+	if !ok || entry.Good == nil || entry.Good.Hash == outcome.hash {
+		agent.logger.Infof("Config file %q has no known good content to roll back to", outcome.name)
+		return
+	}
+	agent.logger.Infof("Rolling back config file %q to remote config %s", outcome.name, entry.Good.ConfigHash)
+	result, err := agent.k8sAPIClient.Orchestrate(entry.Good.Body, entry.Good.ContentType)
+	objects := result.Objects
+	if err == nil {
+		err = agent.k8sAPIClient.WaitReady(ctx, objects, opts)
+	}
+	if err != nil {
+		outcome.err = fmt.Errorf("%w; rollback to remote config %s failed: %v", outcome.err, entry.Good.ConfigHash, err)
+		agent.ledger.fail(outcome.name, outcome.err)
+		return
+	}
+	outcome.err = fmt.Errorf("%w; rolled back, remote config %s is live", outcome.err, entry.Good.ConfigHash)
+	entry.Objects = mergeObjects(objects, entry.Objects)
+	entry.Outcome = outcomeRolledBack
+	entry.Error = outcome.err.Error()
+	agent.ledger.record(outcome.name, entry)
+}
+
+func mergeObjects(refs, more []kube_api.ObjectRef) []kube_api.ObjectRef {
+	seen := make(map[string]struct{}, len(refs))
+	for _, ref := range refs {
+		seen[ref.Key()] = struct{}{}
+	}
+	for _, ref := range more {
+		if _, ok := seen[ref.Key()]; !ok {
+			seen[ref.Key()] = struct{}{}
+			refs = append(refs, ref)
 		}
 	}
+	return refs
+}
+
+// prune deletes the objects applied by an earlier sync that no config file
+// holds anymore and reports whether any was deleted. The ledger forgets an
+// object only once it is gone, one that could not be pruned is tried again on
+// the next sync.
+func (agent *Agent) prune(ctx context.Context) bool {
+	stale := agent.ledger.stale()
+	if len(stale) == 0 {
+		return false
+	}
+	dryRun := agent.cfg.Prune.DryRun || agent.cfg.Apply.DryRun
+	pruned, err := agent.k8sAPIClient.Prune(ctx, stale, dryRun)
+	if err != nil {
+		agent.logger.Errorf("Cannot prune: %v", err)
+	}
+	if dryRun {
+		agent.logger.Infof("Prune dry run, %d of %d stale objects would be deleted", len(pruned), len(stale))
+		return false
+	}
+	agent.ledger.pruned(pruned)
+	agent.logger.Infof("Pruned %d of %d stale objects", len(pruned), len(stale))
+	return len(pruned) > 0
+}
+
+func (agent *Agent) setRemoteConfigStatus(hash []byte, status protobufs.RemoteConfigStatuses, errorMessage string) {
+	err := agent.currentClient().SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
+		LastRemoteConfigHash: hash,
+		Status:               status,
+		ErrorMessage:         errorMessage,
+	})
+	if err != nil {
+		agent.logger.Errorf("Cannot set remote config status: %v", err)
+	}
 }
 
-func generateHash(content []byte) uint64 {
-	h := fnv.New64()
-	h.Write(content)
-	return h.Sum64()
+func generateHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
 }
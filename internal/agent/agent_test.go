@@ -0,0 +1,246 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"in-cluster/internal/config"
+	"in-cluster/pkg/kube_api"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/open-telemetry/opamp-go/client"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// fakeKube stands in for the cluster, calling a method it does not implement
+// panics on the nil K8sAPIClient
+type fakeKube struct {
+	kube_api.K8sAPIClient
+}
+
+func (f *fakeKube) EffectiveConfig(context.Context) (map[string][]byte, error) {
+	return map[string][]byte{}, nil
+}
+
+// newTestAgent returns an agent that is not started, with a context that is
+// cancelled when the test ends
+func newTestAgent(t *testing.T, cfg *config.Config) *Agent {
+	t.Helper()
+	agent := &Agent{
+		logger: zap.NewNop().Sugar(),
+		cfg:    cfg,
+		agentDescription: &protobufs.AgentDescription{
+			IdentifyingAttributes: []*protobufs.KeyValue{{
+				Key:   "service.name",
+				Value: &protobufs.AnyValue{Value: &protobufs.AnyValue_StringValue{StringValue: cfg.AgentType}},
+			}},
+		},
+		remoteConfigs: make(chan *protobufs.AgentRemoteConfig, 1),
+		k8sAPIClient:  &fakeKube{},
+	}
+	agent.ctx, agent.stop = context.WithCancel(context.Background())
+	t.Cleanup(agent.Shutdown)
+	return agent
+}
+
+// waitFor polls cond until it holds or fails the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// rolloutKube applies a config file as a single object named after its body,
+// previews the bodies in dryRun and reports the objects in notReady as never
+// ready
+type rolloutKube struct {
+	fakeKube
+	dryRun   map[string]bool
+	notReady map[string]bool
+
+	mu      sync.Mutex
+	applied []string
+	pruned  []kube_api.ObjectRef
+}
+
+func (k *rolloutKube) Orchestrate(content []byte, _ string) (kube_api.Result, error) {
+	ref := objectRef(string(content))
+	if k.dryRun[string(content)] {
+		return kube_api.Result{DryRun: true, Changes: []kube_api.Change{{Object: ref, Action: kube_api.ActionCreate}}}, nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.applied = append(k.applied, string(content))
+	return kube_api.Result{Objects: []kube_api.ObjectRef{ref}}, nil
+}
+
+func (k *rolloutKube) Prune(_ context.Context, refs []kube_api.ObjectRef, dryRun bool) ([]kube_api.ObjectRef, error) {
+	if !dryRun {
+		k.pruned = append(k.pruned, refs...)
+	}
+	return refs, nil
+}
+
+func (k *rolloutKube) WaitReady(_ context.Context, refs []kube_api.ObjectRef, _ kube_api.ReadinessOptions) error {
+	for _, ref := range refs {
+		if k.notReady[ref.Name] {
+			return fmt.Errorf("%w: %s", kube_api.ErrNotReady, ref.Key())
+		}
+	}
+	return nil
+}
+
+func TestWaitReadyRollsBack(t *testing.T) {
+	good := &knownGood{Hash: "good-hash", ConfigHash: "0a", ContentType: "application/json", Body: []byte("good")}
+	tests := []struct {
+		name        string
+		good        *knownGood
+		noRollback  bool
+		notReady    map[string]bool
+		wantApplied []string
+		wantOutcome outcome
+		wantObjects []string
+		wantErr     string
+	}{
+		{name: "rolled back to the known good body", good: good, notReady: map[string]bool{"bad": true},
+			wantApplied: []string{"good"}, wantOutcome: outcomeRolledBack, wantObjects: []string{"bad", "good"},
+			wantErr: "rolled back, remote config 0a is live"},
+		{name: "known good not ready either", good: good, notReady: map[string]bool{"bad": true, "good": true},
+			wantApplied: []string{"good"}, wantOutcome: outcomeFailed, wantObjects: []string{"bad"},
+			wantErr: "rollback to remote config 0a failed"},
+		{name: "no known good", notReady: map[string]bool{"bad": true},
+			wantOutcome: outcomeFailed, wantObjects: []string{"bad"}, wantErr: "not ready"},
+		{name: "rollback disabled", good: good, noRollback: true, notReady: map[string]bool{"bad": true},
+			wantOutcome: outcomeFailed, wantObjects: []string{"bad"}, wantErr: "not ready"},
+		{name: "ready", good: good, wantOutcome: outcomeApplied, wantObjects: []string{"bad"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Readiness.Rollback = !tt.noRollback
+			agent := newTestAgent(t, cfg)
+			kube := &rolloutKube{notReady: tt.notReady}
+			agent.k8sAPIClient = kube
+			agent.ledger = newLedger(agent.logger, &memStore{}, nil)
+			agent.ledger.record("app.json", ledgerEntry{Hash: "bad-hash", Objects: []kube_api.ObjectRef{objectRef("bad")},
+				Outcome: outcomeApplied, Good: tt.good})
+
+			outcomes := []configFileOutcome{{name: "app.json", hash: "bad-hash", objects: []kube_api.ObjectRef{objectRef("bad")}}}
+			agent.waitReady(context.Background(), outcomes)
+
+			if !reflect.DeepEqual(kube.applied, tt.wantApplied) {
+				t.Errorf("applied %q, want %q", kube.applied, tt.wantApplied)
+			}
+			entry, _ := agent.ledger.entry("app.json")
+			if entry.Outcome != tt.wantOutcome {
+				t.Errorf("Outcome = %q, want %q", entry.Outcome, tt.wantOutcome)
+			}
+			if got := refNames(entry.Objects); !reflect.DeepEqual(got, tt.wantObjects) {
+				t.Errorf("Objects = %q, want %q", got, tt.wantObjects)
+			}
+			err := outcomes[0].err
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("outcome error = %v, want none", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("outcome error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// statusClient records the remote config statuses the agent reports
+type statusClient struct {
+	client.OpAMPClient
+	statuses []*protobufs.RemoteConfigStatus
+}
+
+func (c *statusClient) SetRemoteConfigStatus(status *protobufs.RemoteConfigStatus) error {
+	c.statuses = append(c.statuses, status)
+	return nil
+}
+
+func (c *statusClient) UpdateEffectiveConfig(context.Context) error {
+	return nil
+}
+
+func (c *statusClient) Stop(context.Context) error {
+	return nil
+}
+
+func TestApplyRemoteConfigDryRun(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantStatus  protobufs.RemoteConfigStatuses
+		wantMessage string
+		wantPruned  []string
+		wantFiles   []string
+		wantSaved   bool
+	}{
+		{name: "dry run", body: "preview", wantStatus: protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED,
+			wantMessage: "dry run, 1 of 1 config files were previewed", wantFiles: []string{"old.json"}},
+		{name: "applied", body: "web", wantStatus: protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+			wantPruned: []string{"old"}, wantFiles: []string{"web.json"}, wantSaved: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Prune.Enabled = true
+			agent := newTestAgent(t, cfg)
+			kube := &rolloutKube{dryRun: map[string]bool{"preview": true}}
+			agent.k8sAPIClient = kube
+			opampClient := &statusClient{}
+			agent.opampClient = opampClient
+			store := &memStore{}
+			agent.ledger = newLedger(agent.logger, store, nil)
+			agent.ledger.record("old.json", ledgerEntry{Hash: "old-hash", Objects: []kube_api.ObjectRef{objectRef("old")},
+				Outcome: outcomeApplied})
+
+			hash := []byte{0x0b}
+			agent.applyRemoteConfig(context.Background(), &protobufs.AgentRemoteConfig{
+				ConfigHash: hash,
+				Config: &protobufs.AgentConfigMap{ConfigMap: map[string]*protobufs.AgentConfigFile{
+					tt.body + ".json": {Body: []byte(tt.body), ContentType: "application/json"},
+				}},
+			})
+
+			status := opampClient.statuses[len(opampClient.statuses)-1]
+			if !reflect.DeepEqual(status.LastRemoteConfigHash, hash) || status.Status != tt.wantStatus {
+				t.Errorf("status = %x %s, want %x %s", status.LastRemoteConfigHash, status.Status, hash, tt.wantStatus)
+			}
+			if !strings.Contains(status.ErrorMessage, tt.wantMessage) {
+				t.Errorf("status message = %q, want %q", status.ErrorMessage, tt.wantMessage)
+			}
+			var pruned []string
+			if len(kube.pruned) > 0 {
+				pruned = refNames(kube.pruned)
+			}
+			if !reflect.DeepEqual(pruned, tt.wantPruned) {
+				t.Errorf("pruned %q, want %q", pruned, tt.wantPruned)
+			}
+			var files []string
+			for _, name := range []string{"old.json", "preview.json", "web.json"} {
+				if entry, ok := agent.ledger.entry(name); ok && entry.Outcome != outcomeRemoved {
+					files = append(files, name)
+				}
+			}
+			if !reflect.DeepEqual(files, tt.wantFiles) {
+				t.Errorf("ledger files = %q, want %q", files, tt.wantFiles)
+			}
+			if saved := store.data != nil; saved != tt.wantSaved {
+				t.Errorf("ledger saved = %v, want %v", saved, tt.wantSaved)
+			}
+		})
+	}
+}
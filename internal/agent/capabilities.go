@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// errRestartNotAccepted is returned to the server for a restart command the
+// agent did not advertise
+var errRestartNotAccepted = errors.New("restart command is not accepted, AcceptsRestartCommand is not advertised")
+
+// capabilities derives the advertised capabilities from the configuration.
+// Status reporting is mandatory, the client always sets it.
+func (agent *Agent) capabilities() protobufs.AgentCapabilities {
+	caps := protobufs.AgentCapabilities_AgentCapabilities_ReportsStatus
+	if agent.cfg.RemoteConfig.Accept {
+		caps |= protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig |
+			protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig
+	}
+	if agent.cfg.RemoteConfig.ReportEffectiveConfig {
+		caps |= protobufs.AgentCapabilities_AgentCapabilities_ReportsEffectiveConfig
+	}
+	if agent.cfg.Health.Interval > 0 {
+		caps |= protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth
+	}
+	if agent.cfg.Commands.Restart {
+		caps |= protobufs.AgentCapabilities_AgentCapabilities_AcceptsRestartCommand
+	}
+	return caps
+}
+
+// advertises reports whether every capability in caps is advertised
+func (agent *Agent) advertises(caps protobufs.AgentCapabilities) bool {
+	return agent.capabilities()&caps == caps
+}
+
+// updateEffectiveConfig sends the effective config when it is advertised
+func (agent *Agent) updateEffectiveConfig(ctx context.Context) error {
+	if !agent.advertises(protobufs.AgentCapabilities_AgentCapabilities_ReportsEffectiveConfig) {
+		return nil
+	}
+	return agent.currentClient().UpdateEffectiveConfig(ctx)
+}
+
+// onCommand restarts the agent when the server asks for it and the agent
+// advertised AcceptsRestartCommand
+func (agent *Agent) onCommand(command *protobufs.ServerToAgentCommand) error {
+	if command.Type != protobufs.CommandType_CommandType_Restart {
+		return fmt.Errorf("unsupported command %s", command.Type)
+	}
+	if !agent.advertises(protobufs.AgentCapabilities_AgentCapabilities_AcceptsRestartCommand) {
+		agent.logger.Errorf("Ignoring restart command: %v", errRestartNotAccepted)
+		return errRestartNotAccepted
+	}
+	agent.logger.Infof("Server requested a restart.")
+	// The client waits for its callbacks when it stops, so restart after this one returned.
+	go agent.restart()
+	return nil
+}
+
+// restart stops the watchers and starts them again with a new OpAMP client,
+// which replaces the current one once it is running. The watchers of the
+// previous run have returned before the new ones start.
+func (agent *Agent) restart() {
+	agent.restartMu.Lock()
+	defer agent.restartMu.Unlock()
+	agent.logger.Debugf("Agent restarting...")
+	agent.stopRunning()
+	if err := agent.start(); err != nil {
+		agent.logger.Errorf("Cannot restart agent: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"context"
+	"in-cluster/internal/config"
+	"in-cluster/pkg/kube_api"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+func TestCapabilities(t *testing.T) {
+	const (
+		status          = protobufs.AgentCapabilities_AgentCapabilities_ReportsStatus
+		remoteConfig    = protobufs.AgentCapabilities_AgentCapabilities_AcceptsRemoteConfig
+		reportsConfig   = protobufs.AgentCapabilities_AgentCapabilities_ReportsRemoteConfig
+		effectiveConfig = protobufs.AgentCapabilities_AgentCapabilities_ReportsEffectiveConfig
+		health          = protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth
+		restart         = protobufs.AgentCapabilities_AgentCapabilities_AcceptsRestartCommand
+	)
+	tests := []struct {
+		name   string
+		modify func(c *config.Config)
+		want   protobufs.AgentCapabilities
+	}{
+		{name: "defaults", want: status | remoteConfig | reportsConfig | effectiveConfig | health},
+		{name: "status only", modify: func(c *config.Config) {
+			c.RemoteConfig.Accept = false
+			c.RemoteConfig.ReportEffectiveConfig = false
+			c.Health.Interval = 0
+		}, want: status},
+		{name: "remote config refused", modify: func(c *config.Config) {
+			c.RemoteConfig.Accept = false
+		}, want: status | effectiveConfig | health},
+		{name: "no health", modify: func(c *config.Config) {
+			c.Health.Interval = 0
+		}, want: status | remoteConfig | reportsConfig | effectiveConfig},
+		{name: "restart accepted", modify: func(c *config.Config) {
+			c.Commands.Restart = true
+		}, want: status | remoteConfig | reportsConfig | effectiveConfig | health | restart},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			if tt.modify != nil {
+				tt.modify(cfg)
+			}
+			agent := &Agent{cfg: cfg}
+			if got := agent.capabilities(); got != tt.want {
+				t.Errorf("capabilities() = %b, want %b", got, tt.want)
+			}
+			if !agent.advertises(status) {
+				t.Error("advertises(ReportsStatus) = false")
+			}
+			if got := agent.advertises(restart | status); got != (tt.want&restart != 0) {
+				t.Errorf("advertises(AcceptsRestartCommand|ReportsStatus) = %v", got)
+			}
+		})
+	}
+}
+
+func TestRestartWaitsForPreviousRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An empty body decodes as a ServerToAgent message without content.
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer server.Close()
+
+	cfg := config.Default()
+	cfg.Server.URL = server.URL
+	cfg.Server.Transport = config.TransportHTTP
+	cfg.HeartbeatInterval = 10 * time.Millisecond
+	cfg.Drift.Interval = 0
+	cfg.Health.Interval = 0
+	cfg.RemoteConfig.ReportEffectiveConfig = false
+	agent := newTestAgent(t, cfg)
+	if err := agent.start(); err != nil {
+		t.Fatalf("start() error = %v", err)
+	}
+	previous := agent.context()
+
+	var exited int32
+	agent.goRun(func(ctx context.Context) {
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&exited, 1)
+	})
+
+	// The callbacks keep reading the context of the run while it is replaced
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				agent.onDrift(kube_api.Drift{Ref: objectRef("web")})
+			}
+		}
+	}()
+	agent.restart()
+	close(done)
+	wg.Wait()
+
+	if atomic.LoadInt32(&exited) == 0 {
+		t.Error("restart() started a new run before the goroutines of the previous one returned")
+	}
+	if previous.Err() == nil {
+		t.Error("restart() left the previous run going")
+	}
+	if agent.context().Err() != nil {
+		t.Error("restart() did not start a new run")
+	}
+}
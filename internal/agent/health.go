@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"fmt"
+	"in-cluster/pkg/kube_api"
+	"strings"
+	"time"
+
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// healthKey is the effective config entry listing the health of every object
+const healthKey = "health"
+
+// onHealth records the health of the applied objects and reports it to the
+// server, as AgentHealth and in the effective config. Composing the effective
+// config reads every applied object, it is sent at most once per interval.
+func (agent *Agent) onHealth(health []kube_api.ObjectHealth) {
+	agent.healthMu.Lock()
+	agent.health = health
+	agent.healthMu.Unlock()
+
+	status := agent.agentHealth()
+	if status.Up {
+		agent.logger.Debugf("Applied objects are healthy.")
+	} else {
+		agent.logger.Infof("Applied objects are unhealthy: %s", status.LastError)
+	}
+	if err := agent.currentClient().SetHealth(status); err != nil {
+		agent.logger.Errorf("Cannot report health: %v", err)
+	}
+	agent.reportHealthConfig()
+}
+
+// reportHealthConfig sends the effective config, or schedules it for the end of
+// the interval when it was sent more recently
+func (agent *Agent) reportHealthConfig() {
+	ctx := agent.context()
+	agent.healthMu.Lock()
+	if agent.healthScheduled {
+		agent.healthMu.Unlock()
+		return
+	}
+	wait := agent.cfg.Health.Interval - time.Since(agent.healthSentAt)
+	if wait > 0 {
+		agent.healthScheduled = true
+		agent.healthMu.Unlock()
+		time.AfterFunc(wait, func() {
+			agent.healthMu.Lock()
+			agent.healthScheduled = false
+			agent.healthMu.Unlock()
+			if ctx.Err() == nil {
+				agent.reportHealthConfig()
+			}
+		})
+		return
+	}
+	agent.healthSentAt = time.Now()
+	agent.healthMu.Unlock()
+
+	if err := agent.updateEffectiveConfig(ctx); err != nil {
+		agent.logger.Errorf("Cannot report health of the applied objects: %v", err)
+	}
+}
+
+// agentHealth is up while no applied object is degraded or missing, LastError
+// lists the ones that are
+func (agent *Agent) agentHealth() *protobufs.AgentHealth {
+	agent.healthMu.RLock()
+	defer agent.healthMu.RUnlock()
+
+	var unhealthy []string
+	for _, h := range agent.health {
+		if !h.Healthy() {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s is %s: %s", h.Object.Key(), h.State, h.Message))
+		}
+	}
+	health := &protobufs.AgentHealth{
+		Up:                len(unhealthy) == 0,
+		StartTimeUnixNano: uint64(agent.startedAt.UnixNano()),
+	}
+	if len(unhealthy) > 0 {
+		health.LastError = fmt.Sprintf("%d of %d applied objects unhealthy: %s", len(unhealthy), len(agent.health),
+			strings.Join(unhealthy, "; "))
+	}
+	return health
+}
+
+// healthReport renders the health of every applied object for the effective
+// config, nil before the first report
+func (agent *Agent) healthReport() []kube_api.ObjectHealth {
+	agent.healthMu.RLock()
+	defer agent.healthMu.RUnlock()
+	return agent.health
+}
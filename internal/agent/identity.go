@@ -0,0 +1,88 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"in-cluster/internal/config"
+	"in-cluster/pkg/kube_api"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const instanceUidKey = "instanceUid"
+
+// loadInstanceId resolves the instance uid from the configured source. Persisted
+// sources generate and store a new uid on first start only.
+func (agent *Agent) loadInstanceId(ctx context.Context) (ulid.ULID, error) {
+	switch agent.cfg.InstanceUID.Source {
+	case config.InstanceUIDStatic:
+		return ulid.Parse(agent.cfg.InstanceUID.Value)
+	case config.InstanceUIDDerived:
+		return agent.deriveInstanceId(ctx)
+	case config.InstanceUIDConfigMap, config.InstanceUIDSecret:
+		data, err := agent.identityStore().Load(ctx)
+		if err != nil {
+			return ulid.ULID{}, fmt.Errorf("loading instance uid: %w", err)
+		}
+		if stored, ok := data[instanceUidKey]; ok {
+			agent.logger.Debugf("Loaded instance uid from %s %s/%s", agent.cfg.InstanceUID.Source,
+				agent.cfg.InstanceUID.Namespace, agent.cfg.InstanceUID.Name)
+			return ulid.Parse(stored)
+		}
+		instanceId, err := newInstanceId()
+		if err != nil {
+			return ulid.ULID{}, err
+		}
+		if err = agent.persistInstanceId(ctx, instanceId); err != nil {
+			return ulid.ULID{}, err
+		}
+		return instanceId, nil
+	default:
+		return newInstanceId()
+	}
+}
+
+// persistInstanceId writes the uid back to storage, sources without storage
+// only keep it in memory
+func (agent *Agent) persistInstanceId(ctx context.Context, instanceId ulid.ULID) error {
+	switch agent.cfg.InstanceUID.Source {
+	case config.InstanceUIDConfigMap, config.InstanceUIDSecret:
+		err := agent.identityStore().Save(ctx, map[string]string{instanceUidKey: instanceId.String()})
+		if err != nil {
+			return fmt.Errorf("persisting instance uid: %w", err)
+		}
+		return nil
+	default:
+		agent.logger.Debugf("Instance uid source %s has no storage, uid is kept in memory only",
+			agent.cfg.InstanceUID.Source)
+		return nil
+	}
+}
+
+func (agent *Agent) identityStore() kube_api.Store {
+	kind := kube_api.ConfigMapStore
+	if agent.cfg.InstanceUID.Source == config.InstanceUIDSecret {
+		kind = kube_api.SecretStore
+	}
+	return agent.k8sAPIClient.Store(kind, agent.cfg.InstanceUID.Namespace, agent.cfg.InstanceUID.Name)
+}
+
+// deriveInstanceId hashes the cluster uid, namespace and name into a uid that
+// is the same on every start of the agent in this cluster
+func (agent *Agent) deriveInstanceId(ctx context.Context) (ulid.ULID, error) {
+	clusterUid, err := agent.k8sAPIClient.ClusterUID(ctx)
+	if err != nil {
+		return ulid.ULID{}, fmt.Errorf("reading cluster uid: %w", err)
+	}
+	sum := sha256.Sum256([]byte(clusterUid + "/" + agent.cfg.InstanceUID.Namespace + "/" + agent.cfg.InstanceUID.Name))
+	var instanceId ulid.ULID
+	copy(instanceId[:], sum[:])
+	return instanceId, nil
+}
+
+func newInstanceId() (ulid.ULID, error) {
+	return ulid.New(ulid.Timestamp(time.Now()), rand.Reader)
+}
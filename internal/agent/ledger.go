@@ -0,0 +1,346 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"in-cluster/pkg/kube_api"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const ledgerKey = "ledger.json"
+
+// maxLedgerSize keeps the ledger well under the 1MiB limit of a Secret
+const maxLedgerSize = 768 << 10
+
+type outcome string
+
+const (
+	outcomeApplied    outcome = "applied"
+	outcomeFailed     outcome = "failed"
+	outcomeRolledBack outcome = "rolledBack"
+	// outcomeRemoved marks a file the server no longer sends, its entry is
+	// kept until its objects were pruned
+	outcomeRemoved outcome = "removed"
+)
+
+// ledgerEntry records the last attempt to apply a remote config file. Stale
+// holds the objects earlier attempts applied that the file no longer holds,
+// until they are pruned.
+type ledgerEntry struct {
+	Hash      string               `json:"hash"`
+	AppliedAt time.Time            `json:"appliedAt"`
+	Objects   []kube_api.ObjectRef `json:"objects,omitempty"`
+	Stale     []kube_api.ObjectRef `json:"stale,omitempty"`
+	Outcome   outcome              `json:"outcome"`
+	Error     string               `json:"error,omitempty"`
+	Good      *knownGood           `json:"good,omitempty"`
+}
+
+// knownGood is the last content of a file that was applied and became ready,
+// ConfigHash is the hash of the remote config it was part of
+type knownGood struct {
+	Hash        string `json:"hash"`
+	ConfigHash  string `json:"configHash"`
+	ContentType string `json:"contentType"`
+	Body        []byte `json:"body"`
+}
+
+// ledger is the durable record of applied config files keyed by file name,
+// persisted in a Secret so restarts do not re-apply unchanged files. The known
+// good bodies may hold Secrets, they are never written to a ConfigMap.
+type ledger struct {
+	logger *zap.SugaredLogger
+	store  kube_api.Store
+	// legacy is the ConfigMap earlier versions kept the ledger in, it is read
+	// when the Secret holds no ledger yet and cleared once the Secret is saved
+	legacy      kube_api.Store
+	clearLegacy bool
+
+	mu      sync.RWMutex
+	entries map[string]ledgerEntry
+}
+
+func newLedger(logger *zap.SugaredLogger, store, legacy kube_api.Store) *ledger {
+	return &ledger{
+		logger:  logger,
+		store:   store,
+		legacy:  legacy,
+		entries: make(map[string]ledgerEntry),
+	}
+}
+
+func (l *ledger) load(ctx context.Context) error {
+	data, err := l.store.Load(ctx)
+	if err != nil {
+		return err
+	}
+	raw, ok := data[ledgerKey]
+	if !ok && l.legacy != nil {
+		if data, err = l.legacy.Load(ctx); err != nil {
+			return fmt.Errorf("reading the ledger ConfigMap: %w", err)
+		}
+		raw, ok = data[ledgerKey]
+		l.clearLegacy = ok
+	}
+	entries := make(map[string]ledgerEntry)
+	if ok {
+		if err = json.Unmarshal([]byte(raw), &entries); err != nil {
+			return fmt.Errorf("decoding ledger: %w", err)
+		}
+	}
+	l.mu.Lock()
+	l.entries = entries
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *ledger) save(ctx context.Context) error {
+	raw, err := l.marshal()
+	if err != nil {
+		return err
+	}
+	if err = l.store.Save(ctx, map[string]string{ledgerKey: string(raw)}); err != nil {
+		return err
+	}
+	if l.clearLegacy {
+		if err = l.legacy.Save(ctx, map[string]string{ledgerKey: "{}"}); err != nil {
+			return fmt.Errorf("clearing the ledger ConfigMap: %w", err)
+		}
+		l.clearLegacy = false
+	}
+	return nil
+}
+
+// marshal encodes the entries, the largest known good bodies are dropped
+// while the ledger exceeds maxLedgerSize. Their files cannot be rolled back.
+func (l *ledger) marshal() ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	raw, err := json.Marshal(l.entries)
+	for err == nil && len(raw) > maxLedgerSize {
+		largest := ""
+		for name, entry := range l.entries {
+			if entry.Good != nil && (largest == "" || len(entry.Good.Body) > len(l.entries[largest].Good.Body)) {
+				largest = name
+			}
+		}
+		if largest == "" {
+			return nil, fmt.Errorf("ledger is %d bytes, over the limit of %d bytes", len(raw), maxLedgerSize)
+		}
+		entry := l.entries[largest]
+		entry.Good = nil
+		l.entries[largest] = entry
+		l.logger.Warnf("Dropped the known good content of config file %q, the ledger exceeds %d bytes", largest, maxLedgerSize)
+		raw, err = json.Marshal(l.entries)
+	}
+	return raw, err
+}
+
+// unchanged reports whether the file was already applied successfully with
+// the same content
+func (l *ledger) unchanged(name, hash string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entry, ok := l.entries[name]
+	return ok && entry.Hash == hash && entry.Outcome == outcomeApplied
+}
+
+// rolledBack returns why the file was rolled back when its content did not
+// change since
+func (l *ledger) rolledBack(name, hash string) (string, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entry, ok := l.entries[name]
+	if !ok || entry.Hash != hash || entry.Outcome != outcomeRolledBack {
+		return "", false
+	}
+	return entry.Error, true
+}
+
+func (l *ledger) entry(name string) (ledgerEntry, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	entry, ok := l.entries[name]
+	return entry, ok
+}
+
+// record replaces the entry of the file, the objects of the previous entry
+// that the new one does not hold are kept as stale
+func (l *ledger) record(name string, entry ledgerEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if previous, ok := l.entries[name]; ok {
+		current := make(map[string]struct{}, len(entry.Objects))
+		for _, ref := range entry.Objects {
+			current[ref.Key()] = struct{}{}
+		}
+		var stale []kube_api.ObjectRef
+		for _, ref := range mergeObjects(mergeObjects(mergeObjects(nil, entry.Stale), previous.Objects), previous.Stale) {
+			if _, ok := current[ref.Key()]; !ok {
+				stale = append(stale, ref)
+			}
+		}
+		entry.Stale = stale
+	}
+	l.entries[name] = entry
+}
+
+// fail marks the last attempt of the file as failed
+func (l *ledger) fail(name string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if entry, ok := l.entries[name]; ok {
+		entry.Outcome = outcomeFailed
+		entry.Error = err.Error()
+		l.entries[name] = entry
+	}
+}
+
+// markGood records the file content as the one to roll back to
+func (l *ledger) markGood(name string, good *knownGood) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if entry, ok := l.entries[name]; ok {
+		entry.Good = good
+		l.entries[name] = entry
+	}
+}
+
+// live returns the known good content of the files whose content is live in
+// the cluster, those that were applied or rolled back
+func (l *ledger) live() map[string]*knownGood {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	goods := make(map[string]*knownGood)
+	for name, entry := range l.entries {
+		switch {
+		case entry.Good == nil:
+		case entry.Outcome == outcomeApplied && entry.Good.Hash == entry.Hash, entry.Outcome == outcomeRolledBack:
+			goods[name] = entry.Good
+		}
+	}
+	return goods
+}
+
+// retain marks the files not in names as removed and returns their names.
+// A removed file stays in the ledger until its objects were pruned.
+func (l *ledger) retain(names map[string]struct{}) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var removed []string
+	for name, entry := range l.entries {
+		if _, ok := names[name]; ok || entry.Outcome == outcomeRemoved {
+			continue
+		}
+		removed = append(removed, name)
+		entry.Outcome = outcomeRemoved
+		entry.Good = nil
+		l.entries[name] = entry
+	}
+	sort.Strings(removed)
+	l.forget(nil)
+	return removed
+}
+
+// objects returns the objects of every file that was applied or rolled back
+func (l *ledger) objects() []kube_api.ObjectRef {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var refs []kube_api.ObjectRef
+	for _, entry := range l.entries {
+		if entry.Outcome == outcomeApplied || entry.Outcome == outcomeRolledBack {
+			refs = append(refs, entry.Objects...)
+		}
+	}
+	return refs
+}
+
+// desired returns the objects of every file the server still sends regardless
+// of its outcome, a failed file keeps the objects of its previous attempts
+func (l *ledger) desired() map[string]kube_api.ObjectRef {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.desiredLocked()
+}
+
+func (l *ledger) desiredLocked() map[string]kube_api.ObjectRef {
+	refs := make(map[string]kube_api.ObjectRef)
+	for _, entry := range l.entries {
+		if entry.Outcome == outcomeRemoved {
+			continue
+		}
+		for _, ref := range entry.Objects {
+			refs[ref.Key()] = ref
+		}
+	}
+	return refs
+}
+
+// stale returns the objects no file the server still sends holds: those of
+// removed files and those dropped from a file's content
+func (l *ledger) stale() []kube_api.ObjectRef {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	desired := l.desiredLocked()
+	var refs []kube_api.ObjectRef
+	seen := make(map[string]struct{})
+	for _, entry := range l.entries {
+		candidates := entry.Stale
+		if entry.Outcome == outcomeRemoved {
+			candidates = mergeObjects(mergeObjects(nil, entry.Objects), entry.Stale)
+		}
+		for _, ref := range candidates {
+			if _, ok := desired[ref.Key()]; ok {
+				continue
+			}
+			if _, ok := seen[ref.Key()]; !ok {
+				seen[ref.Key()] = struct{}{}
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs
+}
+
+// pruned forgets the objects that were pruned, and the removed files that
+// have no objects left
+func (l *ledger) pruned(refs []kube_api.ObjectRef) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.forget(refs)
+}
+
+// forget drops the given objects and those another file holds from the stale
+// objects and the removed files, and the removed files left without objects.
+// The caller holds the lock.
+func (l *ledger) forget(refs []kube_api.ObjectRef) {
+	gone := l.desiredLocked()
+	for _, ref := range refs {
+		gone[ref.Key()] = ref
+	}
+	keep := func(refs []kube_api.ObjectRef) []kube_api.ObjectRef {
+		var kept []kube_api.ObjectRef
+		for _, ref := range refs {
+			if _, ok := gone[ref.Key()]; !ok {
+				kept = append(kept, ref)
+			}
+		}
+		return kept
+	}
+	for name, entry := range l.entries {
+		entry.Stale = keep(entry.Stale)
+		if entry.Outcome == outcomeRemoved {
+			entry.Objects = keep(entry.Objects)
+			if len(entry.Objects) == 0 && len(entry.Stale) == 0 {
+				delete(l.entries, name)
+				continue
+			}
+		}
+		l.entries[name] = entry
+	}
+}
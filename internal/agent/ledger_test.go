@@ -0,0 +1,276 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"in-cluster/pkg/kube_api"
+	"reflect"
+	"sort"
+	"testing"
+
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// memStore keeps the stored data in memory
+type memStore struct {
+	data map[string]string
+	err  error
+}
+
+func (s *memStore) Load(context.Context) (map[string]string, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	data := make(map[string]string, len(s.data))
+	for k, v := range s.data {
+		data[k] = v
+	}
+	return data, nil
+}
+
+func (s *memStore) Save(_ context.Context, data map[string]string) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.data == nil {
+		s.data = make(map[string]string)
+	}
+	for k, v := range data {
+		s.data[k] = v
+	}
+	return nil
+}
+
+func objectRef(name string) kube_api.ObjectRef {
+	return kube_api.ObjectRef{
+		GVR:       schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+		Namespace: "default",
+		Name:      name,
+	}
+}
+
+func refNames(refs []kube_api.ObjectRef) []string {
+	names := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		names = append(names, ref.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLedgerSaveLoad(t *testing.T) {
+	store := &memStore{}
+	l := newLedger(zap.NewNop().Sugar(), store, nil)
+	l.record("app.json", ledgerEntry{Hash: "a1", Objects: []kube_api.ObjectRef{objectRef("app")}, Outcome: outcomeApplied})
+	l.record("db.json", ledgerEntry{Hash: "d1", Outcome: outcomeApplied})
+	l.fail("db.json", errors.New("quota exceeded"))
+	if err := l.save(context.Background()); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+
+	loaded := newLedger(zap.NewNop().Sugar(), store, nil)
+	if err := loaded.load(context.Background()); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if !reflect.DeepEqual(loaded.entries, l.entries) {
+		t.Errorf("load() = %+v, want %+v", loaded.entries, l.entries)
+	}
+	if !loaded.unchanged("app.json", "a1") {
+		t.Error("unchanged() of an applied file with the same hash = false")
+	}
+	if loaded.unchanged("app.json", "a2") {
+		t.Error("unchanged() of changed content = true")
+	}
+	if loaded.unchanged("db.json", "d1") {
+		t.Error("unchanged() of a failed file = true")
+	}
+
+	store.err = errors.New("forbidden")
+	if err := loaded.load(context.Background()); err == nil {
+		t.Error("load() of an unreadable store succeeded")
+	}
+}
+
+func TestLedgerDesired(t *testing.T) {
+	l := newLedger(zap.NewNop().Sugar(), &memStore{}, nil)
+	l.record("app.json", ledgerEntry{Hash: "a1", Objects: []kube_api.ObjectRef{objectRef("app")}, Outcome: outcomeApplied})
+	l.record("db.json", ledgerEntry{Hash: "d1", Objects: []kube_api.ObjectRef{objectRef("db")}, Outcome: outcomeFailed})
+	l.record("web.json", ledgerEntry{Hash: "w1", Objects: []kube_api.ObjectRef{objectRef("web")},
+		Outcome: outcomeRolledBack})
+	l.record("old.json", ledgerEntry{Hash: "o1", Objects: []kube_api.ObjectRef{objectRef("old")}, Outcome: outcomeRemoved})
+
+	if got, want := refNames(l.objects()), []string{"app", "web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("objects() = %q, want %q", got, want)
+	}
+	var desired []kube_api.ObjectRef
+	for _, ref := range l.desired() {
+		desired = append(desired, ref)
+	}
+	if got, want := refNames(desired), []string{"app", "db", "web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("desired() = %q, want %q", got, want)
+	}
+}
+
+func TestLedgerRetain(t *testing.T) {
+	l := newLedger(zap.NewNop().Sugar(), &memStore{}, nil)
+	l.record("app.json", ledgerEntry{Hash: "a1", Objects: []kube_api.ObjectRef{objectRef("app")}, Outcome: outcomeApplied})
+	l.record("db.json", ledgerEntry{Hash: "d1", Objects: []kube_api.ObjectRef{objectRef("db")}, Outcome: outcomeApplied,
+		Good: &knownGood{Hash: "d1"}})
+	l.record("empty.json", ledgerEntry{Hash: "e1", Outcome: outcomeFailed})
+
+	removed := l.retain(map[string]struct{}{"app.json": {}})
+	if want := []string{"db.json", "empty.json"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("retain() = %q, want %q", removed, want)
+	}
+	if entry, ok := l.entry("db.json"); !ok || entry.Outcome != outcomeRemoved || entry.Good != nil {
+		t.Errorf("retain() left the dropped file as %+v, want it removed until its objects are pruned", entry)
+	}
+	if _, ok := l.entry("empty.json"); ok {
+		t.Error("retain() kept a dropped file without objects")
+	}
+	if entry, ok := l.entry("app.json"); !ok || entry.Outcome != outcomeApplied {
+		t.Error("retain() changed a file that is still sent")
+	}
+	if removed = l.retain(map[string]struct{}{"app.json": {}}); len(removed) != 0 {
+		t.Errorf("retain() of an already removed file = %q", removed)
+	}
+}
+
+func TestLedgerStale(t *testing.T) {
+	l := newLedger(zap.NewNop().Sugar(), &memStore{}, nil)
+	l.record("app.json", ledgerEntry{Hash: "a1", Outcome: outcomeApplied,
+		Objects: []kube_api.ObjectRef{objectRef("app"), objectRef("cache")}})
+	l.record("db.json", ledgerEntry{Hash: "d1", Outcome: outcomeApplied,
+		Objects: []kube_api.ObjectRef{objectRef("db"), objectRef("shared")}})
+	l.record("web.json", ledgerEntry{Hash: "w1", Outcome: outcomeApplied, Objects: []kube_api.ObjectRef{objectRef("web")}})
+
+	// cache is dropped from app.json, db.json is removed but shared moves to web.json
+	l.record("app.json", ledgerEntry{Hash: "a2", Outcome: outcomeApplied, Objects: []kube_api.ObjectRef{objectRef("app")}})
+	l.record("web.json", ledgerEntry{Hash: "w2", Outcome: outcomeApplied,
+		Objects: []kube_api.ObjectRef{objectRef("web"), objectRef("shared")}})
+	l.retain(map[string]struct{}{"app.json": {}, "web.json": {}})
+
+	if got, want := refNames(l.stale()), []string{"cache", "db"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("stale() = %q, want %q", got, want)
+	}
+
+	// Objects stay in the ledger until they are pruned
+	l.pruned([]kube_api.ObjectRef{objectRef("cache")})
+	if got, want := refNames(l.stale()), []string{"db"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("stale() after pruning cache = %q, want %q", got, want)
+	}
+	if _, ok := l.entry("db.json"); !ok {
+		t.Error("pruned() forgot a removed file whose objects were not pruned")
+	}
+	l.pruned([]kube_api.ObjectRef{objectRef("db")})
+	if _, ok := l.entry("db.json"); ok {
+		t.Error("pruned() kept a removed file without objects")
+	}
+	if stale := l.stale(); len(stale) != 0 {
+		t.Errorf("stale() after pruning everything = %q", refNames(stale))
+	}
+
+	// An object applied again is no longer stale
+	l.record("app.json", ledgerEntry{Hash: "a3", Outcome: outcomeApplied, Objects: []kube_api.ObjectRef{objectRef("app")}})
+	l.record("app.json", ledgerEntry{Hash: "a4", Outcome: outcomeApplied,
+		Objects: []kube_api.ObjectRef{objectRef("cache")}})
+	l.record("app.json", ledgerEntry{Hash: "a5", Outcome: outcomeApplied,
+		Objects: []kube_api.ObjectRef{objectRef("app"), objectRef("cache")}})
+	if stale := l.stale(); len(stale) != 0 {
+		t.Errorf("stale() of objects applied again = %q", refNames(stale))
+	}
+}
+
+func TestLedgerMigratesConfigMap(t *testing.T) {
+	secret := &memStore{}
+	legacy := &memStore{data: map[string]string{ledgerKey: `{"app.json":{"hash":"a1","outcome":"applied"}}`}}
+	l := newLedger(zap.NewNop().Sugar(), secret, legacy)
+	if err := l.load(context.Background()); err != nil {
+		t.Fatalf("load() error = %v", err)
+	}
+	if !l.unchanged("app.json", "a1") {
+		t.Fatal("load() did not read the ledger from the ConfigMap")
+	}
+
+	if err := l.save(context.Background()); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+	if legacy.data[ledgerKey] != "{}" {
+		t.Errorf("save() left %q in the ConfigMap", legacy.data[ledgerKey])
+	}
+	reloaded := newLedger(zap.NewNop().Sugar(), secret, legacy)
+	if err := reloaded.load(context.Background()); err != nil || !reloaded.unchanged("app.json", "a1") {
+		t.Errorf("load() from the Secret = %+v, %v", reloaded.entries, err)
+	}
+
+	// Once cleared the ConfigMap is not written again
+	legacy.err = errors.New("forbidden")
+	if err := reloaded.save(context.Background()); err != nil {
+		t.Errorf("save() after the migration error = %v", err)
+	}
+}
+
+func TestLedgerMarshalTrimsKnownGood(t *testing.T) {
+	body := func(size int) []byte { return make([]byte, size) }
+	l := newLedger(zap.NewNop().Sugar(), &memStore{}, nil)
+	l.record("small.json", ledgerEntry{Hash: "s1", Outcome: outcomeApplied,
+		Good: &knownGood{Hash: "s1", Body: body(1 << 10)}})
+	l.record("large.json", ledgerEntry{Hash: "l1", Outcome: outcomeApplied,
+		Good: &knownGood{Hash: "l1", Body: body(maxLedgerSize / 2)}})
+	l.record("larger.json", ledgerEntry{Hash: "r1", Outcome: outcomeApplied,
+		Good: &knownGood{Hash: "r1", Body: body(maxLedgerSize / 2)}})
+
+	raw, err := l.marshal()
+	if err != nil {
+		t.Fatalf("marshal() error = %v", err)
+	}
+	if len(raw) > maxLedgerSize {
+		t.Errorf("marshal() = %d bytes, over %d", len(raw), maxLedgerSize)
+	}
+	var kept []string
+	for name, entry := range l.entries {
+		if entry.Good != nil {
+			kept = append(kept, name)
+		}
+	}
+	sort.Strings(kept)
+	if len(kept) != 2 || kept[len(kept)-1] != "small.json" {
+		t.Errorf("marshal() kept the known good content of %q, want small.json and one large file", kept)
+	}
+	if _, ok := l.entry("large.json"); !ok {
+		t.Error("marshal() dropped an entry instead of its known good content")
+	}
+
+	l.record("huge.json", ledgerEntry{Hash: "h1", Outcome: outcomeFailed, Error: string(body(maxLedgerSize))})
+	if _, err = l.marshal(); err == nil {
+		t.Error("marshal() of a ledger over the limit without known good content succeeded")
+	}
+}
+
+func TestLedgerLive(t *testing.T) {
+	good := func(hash string) *knownGood { return &knownGood{Hash: hash, Body: []byte(hash)} }
+	l := newLedger(zap.NewNop().Sugar(), &memStore{}, nil)
+	l.record("applied.json", ledgerEntry{Hash: "a1", Outcome: outcomeApplied, Good: good("a1")})
+	l.record("pending.json", ledgerEntry{Hash: "p2", Outcome: outcomeApplied, Good: good("p1")})
+	l.record("failed.json", ledgerEntry{Hash: "f2", Outcome: outcomeFailed, Good: good("f1")})
+	l.record("rolled-back.json", ledgerEntry{Hash: "r2", Outcome: outcomeRolledBack, Error: "not ready",
+		Good: good("r1")})
+	l.record("new.json", ledgerEntry{Hash: "n1", Outcome: outcomeApplied})
+
+	var names []string
+	for name := range l.live() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if want := []string{"applied.json", "rolled-back.json"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("live() = %q, want %q", names, want)
+	}
+
+	if reason, ok := l.rolledBack("rolled-back.json", "r2"); !ok || reason != "not ready" {
+		t.Errorf("rolledBack() = %q, %v, want the rollback reason", reason, ok)
+	}
+	if _, ok := l.rolledBack("rolled-back.json", "r3"); ok {
+		t.Error("rolledBack() of changed content = true")
+	}
+}
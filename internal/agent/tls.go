@@ -0,0 +1,253 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"in-cluster/internal/config"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certReloader keeps the CA pool and client certificate of the OpAMP connection
+// up to date with the files on disk. The tls.Config it builds resolves both on
+// every handshake, so rotated files apply to the next connection.
+type certReloader struct {
+	logger *zap.SugaredLogger
+	cfg    config.TLS
+
+	mu       sync.RWMutex
+	roots    *x509.CertPool
+	cert     *tls.Certificate
+	caData   []byte
+	certData []byte
+	keyData  []byte
+}
+
+func newCertReloader(logger *zap.SugaredLogger, cfg config.TLS) (*certReloader, error) {
+	r := &certReloader{
+		logger: logger,
+		cfg:    cfg,
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns the client side tls configuration. Chain verification is
+// done in VerifyConnection against the current CA pool, which is why the
+// built in verification is turned off.
+func (r *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		ServerName:           r.cfg.ServerName,
+		MinVersion:           config.TLSVersions[r.cfg.MinVersion],
+		InsecureSkipVerify:   true,
+		VerifyConnection:     r.verifyConnection,
+		GetClientCertificate: r.getClientCertificate,
+	}
+}
+
+func (r *certReloader) verifyConnection(cs tls.ConnectionState) error {
+	if r.cfg.InsecureSkipVerify {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("server did not present a certificate")
+	}
+
+	r.mu.RLock()
+	roots := r.roots
+	r.mu.RUnlock()
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		// No client certificate configured, continue without one.
+		return &tls.Certificate{}, nil
+	}
+	return r.cert, nil
+}
+
+// reload re-reads the files and reports whether anything changed
+func (r *certReloader) reload() (bool, error) {
+	caData, err := readOptional(r.cfg.CAFile)
+	if err != nil {
+		return false, err
+	}
+	certData, err := readOptional(r.cfg.CertFile)
+	if err != nil {
+		return false, err
+	}
+	keyData, err := readOptional(r.cfg.KeyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	unchanged := r.roots != nil && bytes.Equal(caData, r.caData) &&
+		bytes.Equal(certData, r.certData) && bytes.Equal(keyData, r.keyData)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	var roots *x509.CertPool
+	if caData != nil {
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caData) {
+			return false, fmt.Errorf("no certificates found in %s", r.cfg.CAFile)
+		}
+	} else if roots, err = x509.SystemCertPool(); err != nil {
+		return false, err
+	}
+
+	var cert *tls.Certificate
+	if certData != nil {
+		pair, err := tls.X509KeyPair(certData, keyData)
+		if err != nil {
+			// A rotation may have replaced the certificate but not yet the key.
+			return false, fmt.Errorf("loading client certificate: %w", err)
+		}
+		cert = &pair
+	}
+
+	r.mu.Lock()
+	r.roots = roots
+	r.cert = cert
+	r.caData, r.certData, r.keyData = caData, certData, keyData
+	r.mu.Unlock()
+	return true, nil
+}
+
+// watch polls the files until ctx is done
+func (r *certReloader) watch(ctx context.Context) {
+	if r.cfg.ReloadInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.cfg.ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			changed, err := r.reload()
+			if err != nil {
+				r.logger.Errorf("Cannot reload TLS files, keeping the previous ones: %v", err)
+				continue
+			}
+			if changed {
+				r.logger.Infof("TLS files changed, reloaded certificates.")
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func readOptional(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return os.ReadFile(path)
+}
+
+// setupTLS prepares the tls configuration when the server URL is secure. The
+// HTTP client of opamp-go ignores StartSettings.TLSConfig, so its requests are
+// routed to a transport of their own.
+func (agent *Agent) setupTLS() error {
+	serverURL, err := endpoint(agent.cfg.Server.URL, config.TransportHTTP)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(serverURL, "https:") {
+		return nil
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return err
+	}
+
+	reloader, err := newCertReloader(agent.logger, agent.cfg.Server.TLS)
+	if err != nil {
+		return err
+	}
+	agent.tlsConfig = reloader.TLSConfig()
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if defaults, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport = defaults.Clone()
+	}
+	transport.TLSClientConfig = agent.tlsConfig
+	useServerTransport(u.Host, transport)
+
+	agent.goRun(reloader.watch)
+	return nil
+}
+
+// serverTransport sends the requests to the OpAMP server through their own
+// transport and passes every other request on to next. The HTTP client of
+// opamp-go always sends through http.DefaultClient, which is where it is
+// installed, so other users of the default client keep their TLS settings.
+type serverTransport struct {
+	next http.RoundTripper
+
+	mu     sync.RWMutex
+	host   string
+	server *http.Transport
+}
+
+var (
+	serverTransports       = &serverTransport{}
+	installServerTransport sync.Once
+)
+
+// useServerTransport routes the requests to host through transport, replacing
+// the transport of a previous start
+func useServerTransport(host string, transport *http.Transport) {
+	installServerTransport.Do(func() {
+		serverTransports.next = http.DefaultClient.Transport
+		if serverTransports.next == nil {
+			serverTransports.next = http.DefaultTransport
+		}
+		http.DefaultClient.Transport = serverTransports
+	})
+
+	serverTransports.mu.Lock()
+	previous := serverTransports.server
+	serverTransports.host, serverTransports.server = host, transport
+	serverTransports.mu.Unlock()
+	if previous != nil {
+		previous.CloseIdleConnections()
+	}
+}
+
+func (t *serverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.RLock()
+	host, server := t.host, t.server
+	t.mu.RUnlock()
+	if server != nil && req.URL.Host == host {
+		return server.RoundTrip(req)
+	}
+	return t.next.RoundTrip(req)
+}
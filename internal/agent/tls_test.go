@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"in-cluster/internal/config"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// writeKeyPair writes a self signed certificate and its key as PEM files
+func writeKeyPair(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func copyFile(t *testing.T, from, to string) {
+	t.Helper()
+	data, err := os.ReadFile(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(to, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloaderReload(t *testing.T) {
+	dir := t.TempDir()
+	firstCert, firstKey := writeKeyPair(t, dir, "first")
+	secondCert, secondKey := writeKeyPair(t, dir, "second")
+	caFile := filepath.Join(dir, "ca.crt")
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	copyFile(t, firstCert, caFile)
+	copyFile(t, firstCert, certFile)
+	copyFile(t, firstKey, keyFile)
+
+	r, err := newCertReloader(zap.NewNop().Sugar(), config.TLS{CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("newCertReloader() error = %v", err)
+	}
+	first, _ := r.getClientCertificate(nil)
+
+	if changed, err := r.reload(); err != nil || changed {
+		t.Errorf("reload() of unchanged files = %v, %v, want false", changed, err)
+	}
+
+	// A rotation that replaced the certificate but not yet its key
+	copyFile(t, secondCert, certFile)
+	if _, err = r.reload(); err == nil || !strings.Contains(err.Error(), "loading client certificate") {
+		t.Errorf("reload() of a mismatched key pair error = %v", err)
+	}
+	if cert, _ := r.getClientCertificate(nil); cert != first {
+		t.Error("reload() replaced the client certificate after an error")
+	}
+
+	copyFile(t, secondKey, keyFile)
+	if changed, err := r.reload(); err != nil || !changed {
+		t.Fatalf("reload() of a rotated key pair = %v, %v, want true", changed, err)
+	}
+	if cert, _ := r.getClientCertificate(nil); cert == first {
+		t.Error("reload() kept the previous client certificate")
+	}
+
+	if err = os.WriteFile(caFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.reload(); err == nil || !strings.Contains(err.Error(), "no certificates found") {
+		t.Errorf("reload() of an invalid CA file error = %v", err)
+	}
+
+	if err = os.Remove(caFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.reload(); err == nil {
+		t.Error("reload() of a missing CA file succeeded")
+	}
+}
+
+func TestSetupTLSKeepsDefaultTransport(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	server := httptest.NewTLSServer(handler)
+	defer server.Close()
+	other := httptest.NewUnstartedServer(handler)
+	// The handshake with other fails on purpose
+	other.Config.ErrorLog = log.New(io.Discard, "", 0)
+	other.StartTLS()
+	defer other.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	writePEM(t, caFile, "CERTIFICATE", server.Certificate().Raw)
+
+	cfg := config.Default()
+	cfg.Server.URL = server.URL
+	cfg.Server.TLS.CAFile = caFile
+	agent := newTestAgent(t, cfg)
+	if err := agent.setupTLS(); err != nil {
+		t.Fatalf("setupTLS() error = %v", err)
+	}
+
+	if c := http.DefaultTransport.(*http.Transport).TLSClientConfig; c != nil && c.VerifyConnection != nil {
+		t.Error("setupTLS() changed the TLS config of http.DefaultTransport")
+	}
+	resp, err := http.DefaultClient.Get(server.URL)
+	if err != nil {
+		t.Fatalf("request to the OpAMP server error = %v", err)
+	}
+	resp.Body.Close()
+	// Only the OpAMP server is trusted through its CA file
+	if resp, err = http.DefaultClient.Get(other.URL); err == nil {
+		resp.Body.Close()
+		t.Error("request to another server used the OpAMP server's TLS config")
+	}
+}
@@ -0,0 +1,168 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"in-cluster/internal/config"
+	"net/url"
+	"sync/atomic"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gorilla/websocket"
+
+	"github.com/open-telemetry/opamp-go/client"
+	"github.com/open-telemetry/opamp-go/protobufs"
+)
+
+// currentClient returns the OpAMP client of the active transport
+func (agent *Agent) currentClient() client.OpAMPClient {
+	agent.clientMu.RLock()
+	defer agent.clientMu.RUnlock()
+	return agent.opampClient
+}
+
+func (agent *Agent) currentTransport() config.Transport {
+	agent.clientMu.RLock()
+	defer agent.clientMu.RUnlock()
+	return agent.transport
+}
+
+// startClient starts a client for the given transport and stops the previous one
+// once the new client is running, so messages in flight are not lost
+func (agent *Agent) startClient(transport config.Transport) error {
+	agent.switchMu.Lock()
+	defer agent.switchMu.Unlock()
+
+	serverURL, err := endpoint(agent.cfg.Server.URL, transport)
+	if err != nil {
+		return err
+	}
+
+	var opampClient client.OpAMPClient
+	switch transport {
+	case config.TransportWebSocket:
+		opampClient = client.NewWebSocket(agent.logger)
+	default:
+		opampClient = client.NewHTTP(agent.logger)
+	}
+
+	if err = opampClient.SetAgentDescription(agent.agentDescription); err != nil {
+		return err
+	}
+	if agent.advertises(protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth) {
+		if err = opampClient.SetHealth(agent.agentHealth()); err != nil {
+			return err
+		}
+	}
+
+	agent.logger.Debugf("Starting OpAMP client, transport=%s, url=%s...", transport, serverURL)
+
+	if err = opampClient.Start(agent.context(), agent.startSettings(serverURL)); err != nil {
+		return err
+	}
+
+	agent.logger.Debugf("OpAMP Client started.")
+
+	agent.clientMu.Lock()
+	previous := agent.opampClient
+	agent.opampClient = opampClient
+	agent.transport = transport
+	agent.clientMu.Unlock()
+
+	atomic.StoreInt32(&agent.connectFailures, 0)
+	if previous != nil {
+		if err = previous.Stop(context.Background()); err != nil {
+			agent.logger.Errorf("Cannot stop previous OpAMP client: %v", err)
+		}
+	}
+	return nil
+}
+
+func (agent *Agent) onConnectFailed(err error) {
+	agent.logger.Errorf("Failed to connect to the server: %v", err)
+	if agent.currentTransport() != config.TransportWebSocket || !agent.cfg.Server.FallbackToHTTP {
+		return
+	}
+
+	failures := atomic.AddInt32(&agent.connectFailures, 1)
+	maxAttempts := agent.cfg.Server.Reconnect.MaxAttempts
+	if !errors.Is(err, websocket.ErrBadHandshake) && (maxAttempts == 0 || int(failures) < maxAttempts) {
+		return
+	}
+	// The callback runs inside the client, which cannot be stopped from here.
+	if atomic.CompareAndSwapInt32(&agent.switching, 0, 1) && !agent.goRun(agent.fallbackToHTTP) {
+		atomic.StoreInt32(&agent.switching, 0)
+	}
+}
+
+// fallbackToHTTP switches to HTTP polling and keeps probing the websocket
+// endpoint, switching back as soon as the upgrade succeeds
+func (agent *Agent) fallbackToHTTP(ctx context.Context) {
+	defer atomic.StoreInt32(&agent.switching, 0)
+
+	agent.logger.Infof("WebSocket connection unavailable, falling back to HTTP polling.")
+	if err := agent.startClient(config.TransportHTTP); err != nil {
+		agent.logger.Errorf("Cannot start HTTP client: %v", err)
+		return
+	}
+
+	policy := backoff.NewExponentialBackOff()
+	policy.InitialInterval = agent.cfg.Server.Reconnect.InitialInterval
+	policy.MaxInterval = agent.cfg.Server.Reconnect.MaxInterval
+	policy.MaxElapsedTime = 0
+
+	err := backoff.Retry(func() error {
+		return agent.probeWebSocket(ctx)
+	}, backoff.WithContext(policy, ctx))
+	if err != nil {
+		// Only returned once the agent is shutting down.
+		return
+	}
+
+	agent.logger.Infof("WebSocket endpoint reachable again, switching back from HTTP polling.")
+	if err = agent.startClient(config.TransportWebSocket); err != nil {
+		agent.logger.Errorf("Cannot start WebSocket client: %v", err)
+	}
+}
+
+// probeWebSocket checks whether the server accepts a websocket upgrade
+func (agent *Agent) probeWebSocket(ctx context.Context) error {
+	serverURL, err := endpoint(agent.cfg.Server.URL, config.TransportWebSocket)
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	settings := agent.startSettings(serverURL)
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = settings.TLSConfig
+	conn, _, err := dialer.DialContext(ctx, serverURL, settings.Header)
+	if err != nil {
+		agent.logger.Debugf("WebSocket probe failed: %v", err)
+		return err
+	}
+	return conn.Close()
+}
+
+// endpoint rewrites the scheme of the server URL to the one the transport expects
+func endpoint(serverURL string, transport config.Transport) (string, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return "", err
+	}
+	secure := u.Scheme == "https" || u.Scheme == "wss"
+	switch transport {
+	case config.TransportWebSocket:
+		u.Scheme = "ws"
+		if secure {
+			u.Scheme = "wss"
+		}
+	case config.TransportHTTP:
+		u.Scheme = "http"
+		if secure {
+			u.Scheme = "https"
+		}
+	default:
+		return "", fmt.Errorf("unsupported transport %q", transport)
+	}
+	return u.String(), nil
+}
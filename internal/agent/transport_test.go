@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"errors"
+	"in-cluster/internal/config"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEndpoint(t *testing.T) {
+	tests := []struct {
+		name      string
+		serverURL string
+		transport config.Transport
+		want      string
+		wantErr   bool
+	}{
+		{name: "http", serverURL: "http://opamp:3000/v1/opamp", transport: config.TransportHTTP,
+			want: "http://opamp:3000/v1/opamp"},
+		{name: "http to websocket", serverURL: "http://opamp:3000/v1/opamp", transport: config.TransportWebSocket,
+			want: "ws://opamp:3000/v1/opamp"},
+		{name: "https to websocket", serverURL: "https://opamp/v1/opamp", transport: config.TransportWebSocket,
+			want: "wss://opamp/v1/opamp"},
+		{name: "wss to http", serverURL: "wss://opamp/v1/opamp?tenant=a", transport: config.TransportHTTP,
+			want: "https://opamp/v1/opamp?tenant=a"},
+		{name: "ws to http", serverURL: "ws://opamp/v1/opamp", transport: config.TransportHTTP,
+			want: "http://opamp/v1/opamp"},
+		{name: "unsupported transport", serverURL: "http://opamp", transport: "grpc", wantErr: true},
+		{name: "invalid url", serverURL: "http://opamp:port", transport: config.TransportHTTP, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := endpoint(tt.serverURL, tt.transport)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("endpoint() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("endpoint() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("endpoint() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOnConnectFailedKeepsTransport(t *testing.T) {
+	tests := []struct {
+		name        string
+		transport   config.Transport
+		fallback    bool
+		maxAttempts int
+		err         error
+	}{
+		{name: "http", transport: config.TransportHTTP, fallback: true, err: websocket.ErrBadHandshake},
+		{name: "fallback disabled", transport: config.TransportWebSocket, err: websocket.ErrBadHandshake},
+		{name: "connection error", transport: config.TransportWebSocket, fallback: true,
+			err: errors.New("connection refused")},
+		{name: "attempts left", transport: config.TransportWebSocket, fallback: true, maxAttempts: 3,
+			err: errors.New("connection refused")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.Server.FallbackToHTTP = tt.fallback
+			cfg.Server.Reconnect.MaxAttempts = tt.maxAttempts
+			agent := newTestAgent(t, cfg)
+			agent.transport = tt.transport
+
+			agent.onConnectFailed(tt.err)
+			if atomic.LoadInt32(&agent.switching) != 0 {
+				t.Error("onConnectFailed() falls back to HTTP polling")
+			}
+		})
+	}
+}
+
+func TestFallbackToHTTP(t *testing.T) {
+	var upgrades, polls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if websocket.IsWebSocketUpgrade(r) {
+			if atomic.LoadInt32(&upgrades) == 0 {
+				http.Error(w, "websocket is not available", http.StatusNotFound)
+				return
+			}
+			conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			for {
+				if _, _, err = conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}
+		// An empty body decodes as a ServerToAgent message without content.
+		atomic.AddInt32(&polls, 1)
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer server.Close()
+
+	cfg := config.Default()
+	cfg.Server.URL = server.URL
+	cfg.Server.Transport = config.TransportWebSocket
+	cfg.Server.Reconnect.InitialInterval = 10 * time.Millisecond
+	cfg.Server.Reconnect.MaxInterval = 50 * time.Millisecond
+	agent := newTestAgent(t, cfg)
+
+	if err := agent.startClient(config.TransportWebSocket); err != nil {
+		t.Fatalf("startClient() error = %v", err)
+	}
+	waitFor(t, "HTTP polling", func() bool {
+		return agent.currentTransport() == config.TransportHTTP && atomic.LoadInt32(&polls) > 0
+	})
+
+	atomic.StoreInt32(&upgrades, 1)
+	waitFor(t, "the switch back to WebSocket", func() bool {
+		return agent.currentTransport() == config.TransportWebSocket && atomic.LoadInt32(&agent.switching) == 0
+	})
+}
@@ -0,0 +1,1038 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Transport string
+
+const (
+	TransportHTTP      Transport = "http"
+	TransportWebSocket Transport = "websocket"
+)
+
+type InstanceUIDSource string
+
+const (
+	// InstanceUIDRandom generates a new instance uid on every start
+	InstanceUIDRandom InstanceUIDSource = "random"
+	// InstanceUIDStatic uses the instance uid provided in the configuration
+	InstanceUIDStatic InstanceUIDSource = "static"
+	// InstanceUIDConfigMap persists the instance uid in a ConfigMap
+	InstanceUIDConfigMap InstanceUIDSource = "configmap"
+	// InstanceUIDSecret persists the instance uid in a Secret
+	InstanceUIDSecret InstanceUIDSource = "secret"
+	// InstanceUIDDerived derives the instance uid from the cluster uid, namespace and name
+	InstanceUIDDerived InstanceUIDSource = "derived"
+)
+
+// Server holds the settings of the OpAMP server connection
+type Server struct {
+	URL       string            `yaml:"url"`
+	Transport Transport         `yaml:"transport"`
+	Headers   map[string]string `yaml:"headers"`
+	// FallbackToHTTP switches a websocket connection to HTTP polling when the upgrade fails
+	FallbackToHTTP bool      `yaml:"fallbackToHttp"`
+	Reconnect      Reconnect `yaml:"reconnect"`
+	TLS            TLS       `yaml:"tls"`
+}
+
+// TLS holds the settings of a https or wss connection, the files are
+// re-read when they change so certificates rotated in a mounted Secret are
+// picked up without a restart
+type TLS struct {
+	CAFile             string        `yaml:"caFile"`
+	CertFile           string        `yaml:"certFile"`
+	KeyFile            string        `yaml:"keyFile"`
+	ServerName         string        `yaml:"serverName"`
+	InsecureSkipVerify bool          `yaml:"insecureSkipVerify"`
+	MinVersion         string        `yaml:"minVersion"`
+	ReloadInterval     time.Duration `yaml:"reloadInterval"`
+}
+
+// Reconnect is the backoff policy used while the websocket connection is down
+type Reconnect struct {
+	InitialInterval time.Duration `yaml:"initialInterval"`
+	MaxInterval     time.Duration `yaml:"maxInterval"`
+	// MaxAttempts is the number of failed websocket connection attempts before
+	// falling back to HTTP, 0 only falls back when the upgrade is refused
+	MaxAttempts int `yaml:"maxAttempts"`
+}
+
+// InstanceUID describes where the agent instance uid comes from
+type InstanceUID struct {
+	Source InstanceUIDSource `yaml:"source"`
+	Value  string            `yaml:"value"`
+	// Namespace and Name locate the ConfigMap or Secret holding the uid, for the
+	// derived source they are hashed together with the cluster uid
+	Namespace string `yaml:"namespace"`
+	Name      string `yaml:"name"`
+}
+
+// Ledger locates the Secret recording the applied config files
+type Ledger struct {
+	Namespace string `yaml:"namespace"`
+	Name      string `yaml:"name"`
+}
+
+// Config is the effective configuration of the agent
+type Config struct {
+	AgentType         string        `yaml:"agentType"`
+	AgentVersion      string        `yaml:"agentVersion"`
+	Server            Server        `yaml:"server"`
+	InstanceUID       InstanceUID   `yaml:"instanceUid"`
+	HeartbeatInterval time.Duration `yaml:"heartbeatInterval"`
+	Namespace         string        `yaml:"namespace"`
+	// AllowedNamespaces the agent may touch, any namespace when empty
+	AllowedNamespaces []string `yaml:"allowedNamespaces"`
+	// AllowClusterScoped lets the agent write cluster scoped kinds while
+	// AllowedNamespaces restricts it, they live outside every namespace
+	AllowClusterScoped bool         `yaml:"allowClusterScoped"`
+	Apply              Apply        `yaml:"apply"`
+	Prune              Prune        `yaml:"prune"`
+	Drift              Drift        `yaml:"drift"`
+	Readiness          Readiness    `yaml:"readiness"`
+	Health             Health       `yaml:"health"`
+	RemoteConfig       RemoteConfig `yaml:"remoteConfig"`
+	Commands           Commands     `yaml:"commands"`
+	Ledger             Ledger       `yaml:"ledger"`
+}
+
+type ApplyMode string
+
+const (
+	ApplyModeUpdate     ApplyMode = "update"
+	ApplyModeServerSide ApplyMode = "server-side"
+)
+
+// Apply controls how resources are written to the cluster
+type Apply struct {
+	Mode           ApplyMode `yaml:"mode"`
+	FieldManager   string    `yaml:"fieldManager"`
+	ForceConflicts bool      `yaml:"forceConflicts"`
+	Atomic         bool      `yaml:"atomic"`
+	DryRun         bool      `yaml:"dryRun"`
+	LegacyPayloads bool      `yaml:"legacyPayloads"`
+}
+
+type DriftPolicy string
+
+const (
+	DriftHeal   DriftPolicy = "heal"
+	DriftReport DriftPolicy = "report"
+	DriftIgnore DriftPolicy = "ignore"
+)
+
+// Drift controls the reconciler comparing applied objects with their desired
+// state, Policy is the default for resources without a policy annotation
+type Drift struct {
+	Policy   DriftPolicy   `yaml:"policy"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Readiness controls how long applied workloads are given to roll out before
+// the remote config is reported FAILED, a zero Timeout reports APPLIED at once.
+// Rollback restores the last known good content of a file that failed.
+type Readiness struct {
+	Timeout  time.Duration `yaml:"timeout"`
+	Interval time.Duration `yaml:"interval"`
+	Rollback bool          `yaml:"rollback"`
+}
+
+// Health controls how often the health of the applied objects is reported
+// besides every status change, a zero Interval disables health reporting
+type Health struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+// RemoteConfig controls whether the agent applies the remote config sent by
+// the server and reports the effective config back
+type RemoteConfig struct {
+	Accept                bool `yaml:"accept"`
+	ReportEffectiveConfig bool `yaml:"reportEffectiveConfig"`
+}
+
+// Commands controls which server commands the agent acts on
+type Commands struct {
+	Restart bool `yaml:"restart"`
+}
+
+// Prune controls the deletion of agent owned objects dropped from the remote
+// config, DryRun only reports them
+type Prune struct {
+	Enabled bool `yaml:"enabled"`
+	DryRun  bool `yaml:"dryRun"`
+}
+
+const configFileEnv = "OPAMP_CONFIG_FILE"
+
+// TLSVersions maps the accepted minVersion values to their crypto/tls constant
+var TLSVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Default returns the configuration used when nothing else is provided
+func Default() *Config {
+	return &Config{
+		AgentType:    "io.opentelemetry.collector",
+		AgentVersion: "1.0.0",
+		Server: Server{
+			URL:            "http://host.minikube.internal:3000/v1/opamp",
+			Transport:      TransportHTTP,
+			Headers:        map[string]string{},
+			FallbackToHTTP: true,
+			Reconnect: Reconnect{
+				InitialInterval: time.Second,
+				MaxInterval:     time.Minute,
+				MaxAttempts:     5,
+			},
+			TLS: TLS{
+				MinVersion:     "1.2",
+				ReloadInterval: time.Minute,
+			},
+		},
+		InstanceUID: InstanceUID{
+			Source:    InstanceUIDRandom,
+			Namespace: os.Getenv("POD_NAMESPACE"),
+			Name:      "opamp-agent-identity",
+		},
+		HeartbeatInterval: 30 * time.Second,
+		Namespace:         "default",
+		Apply: Apply{
+			Mode:         ApplyModeUpdate,
+			FieldManager: "opamp-agent",
+		},
+		Drift: Drift{
+			Policy:   DriftHeal,
+			Interval: 5 * time.Minute,
+		},
+		Readiness: Readiness{
+			Timeout:  5 * time.Minute,
+			Interval: 2 * time.Second,
+			Rollback: true,
+		},
+		Health: Health{
+			Interval: 30 * time.Second,
+		},
+		RemoteConfig: RemoteConfig{
+			Accept:                true,
+			ReportEffectiveConfig: true,
+		},
+		Ledger: Ledger{
+			Namespace: os.Getenv("POD_NAMESPACE"),
+			Name:      "opamp-agent-ledger",
+		},
+	}
+}
+
+// setting binds a single configuration value to its flag and environment variable
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	// boolean settings may be given as a bare flag, -prune means -prune=true
+	boolean bool
+	set     func(c *Config, value string) error
+}
+
+// settingValue holds the command line value of a setting
+type settingValue struct {
+	value   string
+	boolean bool
+}
+
+func (v *settingValue) String() string { return v.value }
+
+func (v *settingValue) Set(value string) error {
+	v.value = value
+	return nil
+}
+
+// IsBoolFlag lets the flag package accept a boolean setting without a value
+func (v *settingValue) IsBoolFlag() bool { return v.boolean }
+
+var settings = []setting{
+	{
+		flag:  "t",
+		env:   "OPAMP_AGENT_TYPE",
+		usage: "Agent Type String",
+		set: func(c *Config, v string) error {
+			c.AgentType = v
+			return nil
+		},
+	},
+	{
+		flag:  "v",
+		env:   "OPAMP_AGENT_VERSION",
+		usage: "Agent Version String",
+		set: func(c *Config, v string) error {
+			c.AgentVersion = v
+			return nil
+		},
+	},
+	{
+		flag:  "server-url",
+		env:   "OPAMP_SERVER_URL",
+		usage: "OpAMP server endpoint",
+		set: func(c *Config, v string) error {
+			c.Server.URL = v
+			return nil
+		},
+	},
+	{
+		flag:  "transport",
+		env:   "OPAMP_TRANSPORT",
+		usage: "OpAMP transport: http, websocket",
+		set: func(c *Config, v string) error {
+			c.Server.Transport = Transport(strings.ToLower(v))
+			return nil
+		},
+	},
+	{
+		flag:  "headers",
+		env:   "OPAMP_HEADERS",
+		usage: "Comma separated list of key=value headers sent to the OpAMP server",
+		set: func(c *Config, v string) error {
+			headers, err := parseHeaders(v)
+			if err != nil {
+				return err
+			}
+			for k, h := range headers {
+				c.Server.Headers[k] = h
+			}
+			return nil
+		},
+	},
+	{
+		flag:    "fallback-to-http",
+		env:     "OPAMP_FALLBACK_TO_HTTP",
+		usage:   "Fall back to HTTP polling when the websocket upgrade fails",
+		boolean: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			c.Server.FallbackToHTTP = b
+			return nil
+		},
+	},
+	{
+		flag:  "reconnect-initial-interval",
+		env:   "OPAMP_RECONNECT_INITIAL_INTERVAL",
+		usage: "Initial backoff between websocket reconnection attempts",
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			c.Server.Reconnect.InitialInterval = d
+			return nil
+		},
+	},
+	{
+		flag:  "reconnect-max-interval",
+		env:   "OPAMP_RECONNECT_MAX_INTERVAL",
+		usage: "Maximum backoff between websocket reconnection attempts",
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			c.Server.Reconnect.MaxInterval = d
+			return nil
+		},
+	},
+	{
+		flag:  "reconnect-max-attempts",
+		env:   "OPAMP_RECONNECT_MAX_ATTEMPTS",
+		usage: "Failed websocket connection attempts before falling back to HTTP",
+		set: func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return err
+			}
+			c.Server.Reconnect.MaxAttempts = n
+			return nil
+		},
+	},
+	{
+		flag:  "tls-ca-file",
+		env:   "OPAMP_TLS_CA_FILE",
+		usage: "CA bundle used to verify the OpAMP server certificate",
+		set: func(c *Config, v string) error {
+			c.Server.TLS.CAFile = v
+			return nil
+		},
+	},
+	{
+		flag:  "tls-cert-file",
+		env:   "OPAMP_TLS_CERT_FILE",
+		usage: "Client certificate presented to the OpAMP server",
+		set: func(c *Config, v string) error {
+			c.Server.TLS.CertFile = v
+			return nil
+		},
+	},
+	{
+		flag:  "tls-key-file",
+		env:   "OPAMP_TLS_KEY_FILE",
+		usage: "Private key of the client certificate",
+		set: func(c *Config, v string) error {
+			c.Server.TLS.KeyFile = v
+			return nil
+		},
+	},
+	{
+		flag:  "tls-server-name",
+		env:   "OPAMP_TLS_SERVER_NAME",
+		usage: "Server name used to verify the OpAMP server certificate",
+		set: func(c *Config, v string) error {
+			c.Server.TLS.ServerName = v
+			return nil
+		},
+	},
+	{
+		flag:    "tls-insecure-skip-verify",
+		env:     "OPAMP_TLS_INSECURE_SKIP_VERIFY",
+		usage:   "Skip verification of the OpAMP server certificate, for labs only",
+		boolean: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			c.Server.TLS.InsecureSkipVerify = b
+			return nil
+		},
+	},
+	{
+		flag:  "tls-min-version",
+		env:   "OPAMP_TLS_MIN_VERSION",
+		usage: "Minimum TLS version: 1.0, 1.1, 1.2, 1.3",
+		set: func(c *Config, v string) error {
+			c.Server.TLS.MinVersion = v
+			return nil
+		},
+	},
+	{
+		flag:  "tls-reload-interval",
+		env:   "OPAMP_TLS_RELOAD_INTERVAL",
+		usage: "Interval between checks of the TLS files for changes",
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			c.Server.TLS.ReloadInterval = d
+			return nil
+		},
+	},
+	{
+		flag:  "instance-uid-source",
+		env:   "OPAMP_INSTANCE_UID_SOURCE",
+		usage: "Source of the agent instance uid: random, static, configmap, secret, derived",
+		set: func(c *Config, v string) error {
+			c.InstanceUID.Source = InstanceUIDSource(strings.ToLower(v))
+			return nil
+		},
+	},
+	{
+		flag:  "instance-uid",
+		env:   "OPAMP_INSTANCE_UID",
+		usage: "Agent instance uid, used with the static source",
+		set: func(c *Config, v string) error {
+			c.InstanceUID.Value = v
+			return nil
+		},
+	},
+	{
+		flag:  "instance-uid-namespace",
+		env:   "OPAMP_INSTANCE_UID_NAMESPACE",
+		usage: "Namespace of the ConfigMap or Secret persisting the instance uid",
+		set: func(c *Config, v string) error {
+			c.InstanceUID.Namespace = v
+			return nil
+		},
+	},
+	{
+		flag:  "instance-uid-name",
+		env:   "OPAMP_INSTANCE_UID_NAME",
+		usage: "Name of the ConfigMap or Secret persisting the instance uid",
+		set: func(c *Config, v string) error {
+			c.InstanceUID.Name = v
+			return nil
+		},
+	},
+	{
+		flag:  "allowed-namespaces",
+		env:   "OPAMP_ALLOWED_NAMESPACES",
+		usage: "Comma separated list of namespaces the agent may touch, any when empty",
+		set: func(c *Config, v string) error {
+			c.AllowedNamespaces = splitList(v)
+			return nil
+		},
+	},
+	{
+		flag:    "allow-cluster-scoped",
+		env:     "OPAMP_ALLOW_CLUSTER_SCOPED",
+		usage:   "Write cluster scoped kinds while allowed-namespaces is set",
+		boolean: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			c.AllowClusterScoped = b
+			return nil
+		},
+	},
+	{
+		flag:  "apply-mode",
+		env:   "OPAMP_APPLY_MODE",
+		usage: "How resources are written: update, server-side",
+		set: func(c *Config, v string) error {
+			c.Apply.Mode = ApplyMode(strings.ToLower(v))
+			return nil
+		},
+	},
+	{
+		flag:  "field-manager",
+		env:   "OPAMP_FIELD_MANAGER",
+		usage: "Field manager name recorded on every write",
+		set: func(c *Config, v string) error {
+			c.Apply.FieldManager = v
+			return nil
+		},
+	},
+	{
+		flag:    "force-conflicts",
+		env:     "OPAMP_FORCE_CONFLICTS",
+		usage:   "Take over fields owned by other managers on server-side apply",
+		boolean: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			c.Apply.ForceConflicts = b
+			return nil
+		},
+	},
+	{
+		flag:    "atomic",
+		env:     "OPAMP_ATOMIC",
+		usage:   "Roll back the applied resources of a bundle when a later one fails",
+		boolean: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			c.Apply.Atomic = b
+			return nil
+		},
+	},
+	{
+		flag:    "dry-run",
+		env:     "OPAMP_DRY_RUN",
+		usage:   "Preview remote configs with a server-side dry run and report the diff instead of applying them",
+		boolean: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			c.Apply.DryRun = b
+			return nil
+		},
+	},
+	{
+		flag:    "legacy-payloads",
+		env:     "OPAMP_LEGACY_PAYLOADS",
+		usage:   "Unescape remote config payloads sent without an envelope the way the first servers escaped them",
+		boolean: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			c.Apply.LegacyPayloads = b
+			return nil
+		},
+	},
+	{
+		flag:    "prune",
+		env:     "OPAMP_PRUNE",
+		usage:   "Delete agent owned objects that were dropped from the remote config",
+		boolean: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			c.Prune.Enabled = b
+			return nil
+		},
+	},
+	{
+		flag:    "prune-dry-run",
+		env:     "OPAMP_PRUNE_DRY_RUN",
+		usage:   "Only report the objects prune would delete",
+		boolean: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			c.Prune.DryRun = b
+			return nil
+		},
+	},
+	{
+		flag:  "drift-policy",
+		env:   "OPAMP_DRIFT_POLICY",
+		usage: "Default handling of drifted resources: heal, report or ignore",
+		set: func(c *Config, v string) error {
+			c.Drift.Policy = DriftPolicy(strings.ToLower(v))
+			return nil
+		},
+	},
+	{
+		flag:  "drift-interval",
+		env:   "OPAMP_DRIFT_INTERVAL",
+		usage: "Interval between full drift scans of the applied resources, 0 disables drift detection",
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			c.Drift.Interval = d
+			return nil
+		},
+	},
+	{
+		flag:  "readiness-timeout",
+		env:   "OPAMP_READINESS_TIMEOUT",
+		usage: "Time applied workloads are given to become ready, 0 reports APPLIED without waiting",
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			c.Readiness.Timeout = d
+			return nil
+		},
+	},
+	{
+		flag:  "readiness-interval",
+		env:   "OPAMP_READINESS_INTERVAL",
+		usage: "Interval between readiness checks of applied workloads",
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			c.Readiness.Interval = d
+			return nil
+		},
+	},
+	{
+		flag:    "rollback",
+		env:     "OPAMP_ROLLBACK",
+		usage:   "Restore the last known good config of workloads that do not become ready",
+		boolean: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			c.Readiness.Rollback = b
+			return nil
+		},
+	},
+	{
+		flag:  "health-interval",
+		env:   "OPAMP_HEALTH_INTERVAL",
+		usage: "Interval between health checks of the applied resources, 0 disables health reporting",
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			c.Health.Interval = d
+			return nil
+		},
+	},
+	{
+		flag:    "accept-remote-config",
+		env:     "OPAMP_ACCEPT_REMOTE_CONFIG",
+		usage:   "Apply the remote config sent by the server",
+		boolean: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			c.RemoteConfig.Accept = b
+			return nil
+		},
+	},
+	{
+		flag:    "report-effective-config",
+		env:     "OPAMP_REPORT_EFFECTIVE_CONFIG",
+		usage:   "Report the live state of the applied resources as effective config",
+		boolean: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			c.RemoteConfig.ReportEffectiveConfig = b
+			return nil
+		},
+	},
+	{
+		flag:    "accept-restart-command",
+		env:     "OPAMP_ACCEPT_RESTART_COMMAND",
+		usage:   "Restart the agent when the server sends the restart command",
+		boolean: true,
+		set: func(c *Config, v string) error {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			c.Commands.Restart = b
+			return nil
+		},
+	},
+	{
+		flag:  "ledger-namespace",
+		env:   "OPAMP_LEDGER_NAMESPACE",
+		usage: "Namespace of the Secret recording applied config files",
+		set: func(c *Config, v string) error {
+			c.Ledger.Namespace = v
+			return nil
+		},
+	},
+	{
+		flag:  "ledger-name",
+		env:   "OPAMP_LEDGER_NAME",
+		usage: "Name of the Secret recording applied config files",
+		set: func(c *Config, v string) error {
+			c.Ledger.Name = v
+			return nil
+		},
+	},
+	{
+		flag:  "heartbeat-interval",
+		env:   "OPAMP_HEARTBEAT_INTERVAL",
+		usage: "Interval between status reports sent to the OpAMP server, 0 disables it",
+		set: func(c *Config, v string) error {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return err
+			}
+			c.HeartbeatInterval = d
+			return nil
+		},
+	},
+	{
+		flag:  "namespace",
+		env:   "OPAMP_TARGET_NAMESPACE",
+		usage: "Namespace the agent orchestrates resources in",
+		set: func(c *Config, v string) error {
+			c.Namespace = v
+			return nil
+		},
+	},
+}
+
+// Load builds the configuration from, in increasing order of precedence, the
+// defaults, the YAML config file, environment variables and command line flags.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	configFile := fs.String("config", "", "Path to the YAML config file")
+	values := make(map[string]*settingValue, len(settings))
+	for _, s := range settings {
+		values[s.flag] = &settingValue{boolean: s.boolean}
+		fs.Var(values[s.flag], s.flag, fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv(configFileEnv)
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		v, ok := os.LookupEnv(s.env)
+		if !ok || v == "" {
+			continue
+		}
+		if err := s.set(cfg, v); err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", s.env, err)
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		for _, s := range settings {
+			if s.flag != f.Name {
+				continue
+			}
+			if e := s.set(cfg, values[s.flag].value); e != nil {
+				err = fmt.Errorf("invalid value for -%s: %w", s.flag, e)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.InstanceUID.Namespace == "" {
+		cfg.InstanceUID.Namespace = cfg.Namespace
+	}
+	if cfg.Ledger.Namespace == "" {
+		cfg.Ledger.Namespace = cfg.Namespace
+	}
+
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	if err = yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	if c.Server.Headers == nil {
+		c.Server.Headers = map[string]string{}
+	}
+	return nil
+}
+
+// Validate checks the configuration and reports every invalid setting at once
+func (c *Config) Validate() error {
+	var errs []string
+	if c.AgentType == "" {
+		errs = append(errs, "agentType must not be empty")
+	}
+	if c.AgentVersion == "" {
+		errs = append(errs, "agentVersion must not be empty")
+	}
+	if u, err := url.Parse(c.Server.URL); err != nil || u.Host == "" {
+		errs = append(errs, fmt.Sprintf("server.url %q is not a valid URL", c.Server.URL))
+	} else {
+		switch u.Scheme {
+		case "http", "ws":
+			if c.Server.TLS.CAFile != "" || c.Server.TLS.CertFile != "" || c.Server.TLS.KeyFile != "" {
+				errs = append(errs, fmt.Sprintf("server.tls requires a https or wss server.url, got %q", u.Scheme))
+			}
+		case "https", "wss":
+		default:
+			errs = append(errs, fmt.Sprintf("server.url scheme %q is not supported", u.Scheme))
+		}
+	}
+	if (c.Server.TLS.CertFile == "") != (c.Server.TLS.KeyFile == "") {
+		errs = append(errs, "server.tls.certFile and server.tls.keyFile must be set together")
+	}
+	if _, ok := TLSVersions[c.Server.TLS.MinVersion]; !ok {
+		errs = append(errs, fmt.Sprintf("server.tls.minVersion %q is not supported", c.Server.TLS.MinVersion))
+	}
+	if c.Server.TLS.ReloadInterval < 0 {
+		errs = append(errs, "server.tls.reloadInterval must not be negative")
+	}
+	switch c.Server.Transport {
+	case TransportHTTP, TransportWebSocket:
+	default:
+		errs = append(errs, fmt.Sprintf("server.transport %q is not supported", c.Server.Transport))
+	}
+	if c.Server.Reconnect.InitialInterval <= 0 {
+		errs = append(errs, "server.reconnect.initialInterval must be positive")
+	}
+	if c.Server.Reconnect.MaxInterval < c.Server.Reconnect.InitialInterval {
+		errs = append(errs, "server.reconnect.maxInterval must not be lower than initialInterval")
+	}
+	if c.Server.Reconnect.MaxAttempts < 0 {
+		errs = append(errs, "server.reconnect.maxAttempts must not be negative")
+	}
+	switch c.InstanceUID.Source {
+	case InstanceUIDRandom:
+	case InstanceUIDStatic:
+		if c.InstanceUID.Value == "" {
+			errs = append(errs, "instanceUid.value is required for the static source")
+		}
+	case InstanceUIDConfigMap, InstanceUIDSecret, InstanceUIDDerived:
+		if c.InstanceUID.Namespace == "" || c.InstanceUID.Name == "" {
+			errs = append(errs, fmt.Sprintf("instanceUid.namespace and instanceUid.name are required for the %s source", c.InstanceUID.Source))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("instanceUid.source %q is not supported", c.InstanceUID.Source))
+	}
+	if c.HeartbeatInterval < 0 {
+		errs = append(errs, "heartbeatInterval must not be negative")
+	}
+	if c.Namespace == "" {
+		errs = append(errs, "namespace must not be empty")
+	}
+	if len(c.AllowedNamespaces) > 0 && !contains(c.AllowedNamespaces, c.Namespace) {
+		errs = append(errs, fmt.Sprintf("namespace %q is not in allowedNamespaces", c.Namespace))
+	}
+	switch c.Apply.Mode {
+	case ApplyModeUpdate, ApplyModeServerSide:
+	default:
+		errs = append(errs, fmt.Sprintf("apply.mode %q is not supported", c.Apply.Mode))
+	}
+	if c.Apply.FieldManager == "" {
+		errs = append(errs, "apply.fieldManager must not be empty")
+	}
+	switch c.Drift.Policy {
+	case DriftHeal, DriftReport, DriftIgnore:
+	default:
+		errs = append(errs, fmt.Sprintf("drift.policy %q is not supported", c.Drift.Policy))
+	}
+	if c.Drift.Interval < 0 {
+		errs = append(errs, "drift.interval must not be negative")
+	}
+	if c.Readiness.Timeout < 0 {
+		errs = append(errs, "readiness.timeout must not be negative")
+	}
+	if c.Readiness.Interval <= 0 {
+		errs = append(errs, "readiness.interval must be positive")
+	}
+	if c.Health.Interval < 0 {
+		errs = append(errs, "health.interval must not be negative")
+	}
+	if c.Ledger.Namespace == "" || c.Ledger.Name == "" {
+		errs = append(errs, "ledger.namespace and ledger.name must not be empty")
+	}
+	if len(errs) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Summary renders the effective settings, header values are redacted as they
+// usually carry credentials
+func (c *Config) Summary() string {
+	headers := make([]string, 0, len(c.Server.Headers))
+	for k := range c.Server.Headers {
+		headers = append(headers, k+"=***")
+	}
+	sort.Strings(headers)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "agentType=%s ", c.AgentType)
+	fmt.Fprintf(&b, "agentVersion=%s ", c.AgentVersion)
+	fmt.Fprintf(&b, "server.url=%s ", c.Server.URL)
+	fmt.Fprintf(&b, "server.transport=%s ", c.Server.Transport)
+	fmt.Fprintf(&b, "server.headers=[%s] ", strings.Join(headers, ","))
+	fmt.Fprintf(&b, "server.fallbackToHttp=%t ", c.Server.FallbackToHTTP)
+	fmt.Fprintf(&b, "server.reconnect=%s..%s/%d ", c.Server.Reconnect.InitialInterval,
+		c.Server.Reconnect.MaxInterval, c.Server.Reconnect.MaxAttempts)
+	fmt.Fprintf(&b, "server.tls.caFile=%s ", c.Server.TLS.CAFile)
+	fmt.Fprintf(&b, "server.tls.certFile=%s ", c.Server.TLS.CertFile)
+	fmt.Fprintf(&b, "server.tls.serverName=%s ", c.Server.TLS.ServerName)
+	fmt.Fprintf(&b, "server.tls.insecureSkipVerify=%t ", c.Server.TLS.InsecureSkipVerify)
+	fmt.Fprintf(&b, "server.tls.minVersion=%s ", c.Server.TLS.MinVersion)
+	fmt.Fprintf(&b, "instanceUid.source=%s ", c.InstanceUID.Source)
+	fmt.Fprintf(&b, "instanceUid.ref=%s/%s ", c.InstanceUID.Namespace, c.InstanceUID.Name)
+	fmt.Fprintf(&b, "heartbeatInterval=%s ", c.HeartbeatInterval)
+	fmt.Fprintf(&b, "namespace=%s ", c.Namespace)
+	fmt.Fprintf(&b, "allowedNamespaces=[%s] ", strings.Join(c.AllowedNamespaces, ","))
+	fmt.Fprintf(&b, "allowClusterScoped=%t ", c.AllowClusterScoped)
+	fmt.Fprintf(&b, "apply.mode=%s ", c.Apply.Mode)
+	fmt.Fprintf(&b, "apply.fieldManager=%s ", c.Apply.FieldManager)
+	fmt.Fprintf(&b, "apply.forceConflicts=%t ", c.Apply.ForceConflicts)
+	fmt.Fprintf(&b, "apply.atomic=%t ", c.Apply.Atomic)
+	fmt.Fprintf(&b, "apply.dryRun=%t ", c.Apply.DryRun)
+	fmt.Fprintf(&b, "apply.legacyPayloads=%t ", c.Apply.LegacyPayloads)
+	fmt.Fprintf(&b, "prune.enabled=%t ", c.Prune.Enabled)
+	fmt.Fprintf(&b, "prune.dryRun=%t ", c.Prune.DryRun)
+	fmt.Fprintf(&b, "drift.policy=%s ", c.Drift.Policy)
+	fmt.Fprintf(&b, "drift.interval=%s ", c.Drift.Interval)
+	fmt.Fprintf(&b, "readiness.timeout=%s ", c.Readiness.Timeout)
+	fmt.Fprintf(&b, "readiness.interval=%s ", c.Readiness.Interval)
+	fmt.Fprintf(&b, "readiness.rollback=%t ", c.Readiness.Rollback)
+	fmt.Fprintf(&b, "health.interval=%s ", c.Health.Interval)
+	fmt.Fprintf(&b, "remoteConfig.accept=%t ", c.RemoteConfig.Accept)
+	fmt.Fprintf(&b, "remoteConfig.reportEffectiveConfig=%t ", c.RemoteConfig.ReportEffectiveConfig)
+	fmt.Fprintf(&b, "commands.restart=%t ", c.Commands.Restart)
+	fmt.Fprintf(&b, "ledger=%s/%s", c.Ledger.Namespace, c.Ledger.Name)
+	return b.String()
+}
+
+func parseHeaders(value string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("header %q is not in key=value form", pair)
+		}
+		headers[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return headers, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
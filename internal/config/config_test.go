@@ -0,0 +1,358 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		args    []string
+		check   func(t *testing.T, c *Config)
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, c *Config) {
+				if c.Server.URL != "http://host.minikube.internal:3000/v1/opamp" || c.Namespace != "default" {
+					t.Errorf("Load() = %s %s, want the defaults", c.Server.URL, c.Namespace)
+				}
+				if c.Server.Transport != TransportHTTP || c.HeartbeatInterval != 30*time.Second {
+					t.Errorf("Load() = %s %s, want the defaults", c.Server.Transport, c.HeartbeatInterval)
+				}
+				if c.Ledger.Namespace != "default" || c.Ledger.Name != "opamp-agent-ledger" {
+					t.Errorf("Ledger = %+v, want the target namespace", c.Ledger)
+				}
+			},
+		},
+		{
+			name: "flag over env over file",
+			file: "agentVersion: 2.0.0\nnamespace: file\nheartbeatInterval: 10s\n",
+			env:  map[string]string{"OPAMP_TARGET_NAMESPACE": "env", "OPAMP_HEARTBEAT_INTERVAL": "20s"},
+			args: []string{"-namespace", "flag"},
+			check: func(t *testing.T, c *Config) {
+				if c.Namespace != "flag" {
+					t.Errorf("Namespace = %q, want the flag", c.Namespace)
+				}
+				if c.HeartbeatInterval != 20*time.Second {
+					t.Errorf("HeartbeatInterval = %s, want the env", c.HeartbeatInterval)
+				}
+				if c.AgentVersion != "2.0.0" {
+					t.Errorf("AgentVersion = %q, want the file", c.AgentVersion)
+				}
+			},
+		},
+		{
+			name: "headers",
+			file: "server:\n  headers:\n    X-Org: file\n",
+			env:  map[string]string{"OPAMP_HEADERS": "Authorization=Bearer token, X-Tenant=a"},
+			check: func(t *testing.T, c *Config) {
+				want := map[string]string{"X-Org": "file", "Authorization": "Bearer token", "X-Tenant": "a"}
+				if !reflect.DeepEqual(c.Server.Headers, want) {
+					t.Errorf("Server.Headers = %v, want %v", c.Server.Headers, want)
+				}
+			},
+		},
+		{
+			name: "websocket",
+			env:  map[string]string{"OPAMP_TRANSPORT": "WebSocket"},
+			args: []string{"-fallback-to-http=false", "-reconnect-max-attempts", "3"},
+			check: func(t *testing.T, c *Config) {
+				if c.Server.Transport != TransportWebSocket || c.Server.FallbackToHTTP || c.Server.Reconnect.MaxAttempts != 3 {
+					t.Errorf("Server = %+v, want websocket without fallback after 3 attempts", c.Server)
+				}
+			},
+		},
+		{
+			name: "tls",
+			env:  map[string]string{"OPAMP_SERVER_URL": "https://opamp.example.com/v1/opamp", "OPAMP_TLS_CA_FILE": "/etc/ca.pem"},
+			args: []string{"-tls-min-version", "1.3"},
+			check: func(t *testing.T, c *Config) {
+				if c.Server.TLS.CAFile != "/etc/ca.pem" || c.Server.TLS.MinVersion != "1.3" {
+					t.Errorf("Server.TLS = %+v, want the CA file and TLS 1.3", c.Server.TLS)
+				}
+			},
+		},
+		{
+			name: "instance uid namespace",
+			args: []string{"-namespace", "apps", "-instance-uid-source", "secret"},
+			check: func(t *testing.T, c *Config) {
+				if c.InstanceUID.Namespace != "apps" || c.InstanceUID.Name != "opamp-agent-identity" {
+					t.Errorf("InstanceUID = %+v, want the target namespace", c.InstanceUID)
+				}
+			},
+		},
+		{
+			name: "pod namespace",
+			env:  map[string]string{"POD_NAMESPACE": "agent", "OPAMP_TARGET_NAMESPACE": "apps"},
+			check: func(t *testing.T, c *Config) {
+				if c.InstanceUID.Namespace != "agent" || c.Ledger.Namespace != "agent" {
+					t.Errorf("instance uid and ledger namespaces = %q, %q, want the pod namespace",
+						c.InstanceUID.Namespace, c.Ledger.Namespace)
+				}
+			},
+		},
+		{
+			name: "allowed namespaces",
+			env:  map[string]string{"OPAMP_ALLOWED_NAMESPACES": "default, apps", "OPAMP_ALLOW_CLUSTER_SCOPED": "true"},
+			check: func(t *testing.T, c *Config) {
+				if !reflect.DeepEqual(c.AllowedNamespaces, []string{"default", "apps"}) || !c.AllowClusterScoped {
+					t.Errorf("AllowedNamespaces, AllowClusterScoped = %q, %v", c.AllowedNamespaces, c.AllowClusterScoped)
+				}
+			},
+		},
+		{
+			name: "apply",
+			args: []string{"-apply-mode", "Server-Side", "-force-conflicts"},
+			check: func(t *testing.T, c *Config) {
+				if c.Apply.Mode != ApplyModeServerSide || !c.Apply.ForceConflicts || c.Apply.FieldManager != "opamp-agent" {
+					t.Errorf("Apply = %+v, want server-side apply forcing conflicts", c.Apply)
+				}
+			},
+		},
+		{
+			name: "prune",
+			env:  map[string]string{"OPAMP_PRUNE": "true", "OPAMP_PRUNE_DRY_RUN": "true"},
+			args: []string{"-prune=false"},
+			check: func(t *testing.T, c *Config) {
+				if c.Prune.Enabled || !c.Prune.DryRun {
+					t.Errorf("Prune = %+v, want a disabled dry run", c.Prune)
+				}
+			},
+		},
+		{
+			name: "drift",
+			env:  map[string]string{"OPAMP_DRIFT_POLICY": "Report"},
+			args: []string{"-drift-interval", "0"},
+			check: func(t *testing.T, c *Config) {
+				if c.Drift.Policy != DriftReport || c.Drift.Interval != 0 {
+					t.Errorf("Drift = %+v, want a report policy without scans", c.Drift)
+				}
+			},
+		},
+		{
+			name: "readiness",
+			env:  map[string]string{"OPAMP_READINESS_TIMEOUT": "1m", "OPAMP_ROLLBACK": "false"},
+			check: func(t *testing.T, c *Config) {
+				if c.Readiness.Timeout != time.Minute || c.Readiness.Interval != 2*time.Second || c.Readiness.Rollback {
+					t.Errorf("Readiness = %+v, want a minute without rollback", c.Readiness)
+				}
+			},
+		},
+		{
+			name: "dry run",
+			env:  map[string]string{"OPAMP_DRY_RUN": "true"},
+			check: func(t *testing.T, c *Config) {
+				if !c.Apply.DryRun || c.Apply.Mode != ApplyModeUpdate {
+					t.Errorf("Apply = %+v, want a dry run in update mode", c.Apply)
+				}
+			},
+		},
+		{
+			name: "legacy payloads",
+			file: "apply:\n  legacyPayloads: true\n",
+			check: func(t *testing.T, c *Config) {
+				if !c.Apply.LegacyPayloads || c.Apply.FieldManager != "opamp-agent" {
+					t.Errorf("Apply = %+v, want legacy payloads over the defaults", c.Apply)
+				}
+			},
+		},
+		{
+			name: "health",
+			file: "health:\n  interval: 1m\n",
+			check: func(t *testing.T, c *Config) {
+				if c.Health.Interval != time.Minute {
+					t.Errorf("Health.Interval = %s, want the file", c.Health.Interval)
+				}
+			},
+		},
+		{
+			name: "capabilities",
+			env:  map[string]string{"OPAMP_REPORT_EFFECTIVE_CONFIG": "false"},
+			args: []string{"-accept-restart-command"},
+			check: func(t *testing.T, c *Config) {
+				if !c.RemoteConfig.Accept || c.RemoteConfig.ReportEffectiveConfig || !c.Commands.Restart {
+					t.Errorf("RemoteConfig, Commands = %+v, %+v", c.RemoteConfig, c.Commands)
+				}
+			},
+		},
+		{
+			name: "boolean flags without a value",
+			args: []string{"-prune", "-dry-run", "-namespace", "apps"},
+			check: func(t *testing.T, c *Config) {
+				if !c.Prune.Enabled || !c.Apply.DryRun || c.Namespace != "apps" {
+					t.Errorf("Prune.Enabled, Apply.DryRun, Namespace = %v, %v, %q", c.Prune.Enabled, c.Apply.DryRun, c.Namespace)
+				}
+			},
+		},
+		{
+			name:    "invalid env",
+			env:     map[string]string{"OPAMP_HEARTBEAT_INTERVAL": "often"},
+			wantErr: "invalid value for OPAMP_HEARTBEAT_INTERVAL",
+		},
+		{
+			name:    "invalid flag",
+			args:    []string{"-headers", "Authorization"},
+			wantErr: "invalid value for -headers",
+		},
+		{
+			name:    "invalid setting",
+			args:    []string{"-transport=grpc"},
+			wantErr: `server.transport "grpc" is not supported`,
+		},
+		{
+			name:    "invalid cluster scoped",
+			env:     map[string]string{"OPAMP_ALLOW_CLUSTER_SCOPED": "maybe"},
+			wantErr: "invalid value for OPAMP_ALLOW_CLUSTER_SCOPED",
+		},
+		{
+			name:    "invalid health interval",
+			args:    []string{"-health-interval", "often"},
+			wantErr: "invalid value for -health-interval",
+		},
+		{
+			name:    "invalid boolean flag",
+			args:    []string{"-prune=maybe"},
+			wantErr: "invalid value for -prune",
+		},
+		{
+			name:    "invalid file",
+			file:    "namespace: [",
+			wantErr: "parsing config file",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("POD_NAMESPACE", "")
+			t.Setenv(configFileEnv, "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "config.yaml")
+				if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv(configFileEnv, path)
+			}
+
+			c, err := Load(flag.NewFlagSet(tt.name, flag.ContinueOnError), tt.args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			tt.check(t, c)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(c *Config)
+		wantErr string
+	}{
+		{name: "defaults", mutate: func(c *Config) {}},
+		{name: "https", mutate: func(c *Config) { c.Server.URL = "https://opamp.example.com/v1/opamp" }},
+		{name: "invalid url", mutate: func(c *Config) { c.Server.URL = "opamp" }, wantErr: `server.url "opamp" is not a valid URL`},
+		{name: "unsupported scheme", mutate: func(c *Config) { c.Server.URL = "ftp://opamp" },
+			wantErr: `server.url scheme "ftp" is not supported`},
+		{name: "transport", mutate: func(c *Config) { c.Server.Transport = "grpc" },
+			wantErr: `server.transport "grpc" is not supported`},
+		{name: "static uid without value", mutate: func(c *Config) { c.InstanceUID.Source = InstanceUIDStatic },
+			wantErr: "instanceUid.value is required for the static source"},
+		{name: "unknown uid source", mutate: func(c *Config) { c.InstanceUID.Source = "hostname" },
+			wantErr: `instanceUid.source "hostname" is not supported`},
+		{name: "heartbeat interval", mutate: func(c *Config) { c.HeartbeatInterval = -time.Second },
+			wantErr: "heartbeatInterval must not be negative"},
+		{name: "websocket", mutate: func(c *Config) {
+			c.Server.URL = "wss://opamp.example.com/v1/opamp"
+			c.Server.Transport = TransportWebSocket
+		}},
+		{name: "reconnect intervals", mutate: func(c *Config) { c.Server.Reconnect.MaxInterval = time.Millisecond },
+			wantErr: "server.reconnect.maxInterval must not be lower than initialInterval"},
+		{name: "reconnect attempts", mutate: func(c *Config) { c.Server.Reconnect.MaxAttempts = -1 },
+			wantErr: "server.reconnect.maxAttempts must not be negative"},
+		{name: "https with tls", mutate: func(c *Config) {
+			c.Server.URL = "https://opamp.example.com/v1/opamp"
+			c.Server.TLS.CAFile = "/etc/ca.pem"
+			c.Server.TLS.CertFile, c.Server.TLS.KeyFile = "/etc/tls.crt", "/etc/tls.key"
+		}},
+		{name: "tls over http", mutate: func(c *Config) { c.Server.TLS.CAFile = "/etc/ca.pem" },
+			wantErr: "server.tls requires a https or wss server.url"},
+		{name: "cert without key", mutate: func(c *Config) {
+			c.Server.URL = "wss://opamp"
+			c.Server.TLS.CertFile = "/etc/tls.crt"
+		}, wantErr: "server.tls.certFile and server.tls.keyFile must be set together"},
+		{name: "tls version", mutate: func(c *Config) { c.Server.TLS.MinVersion = "1.4" },
+			wantErr: `server.tls.minVersion "1.4" is not supported`},
+		{name: "tls reload interval", mutate: func(c *Config) { c.Server.TLS.ReloadInterval = -time.Second },
+			wantErr: "server.tls.reloadInterval must not be negative"},
+		{name: "secret uid without namespace", mutate: func(c *Config) {
+			c.InstanceUID.Source = InstanceUIDSecret
+			c.InstanceUID.Namespace = ""
+		}, wantErr: "instanceUid.namespace and instanceUid.name are required for the secret source"},
+		{name: "ledger", mutate: func(c *Config) { c.Ledger.Name = "" },
+			wantErr: "ledger.namespace and ledger.name must not be empty"},
+		{name: "namespace not allowed", mutate: func(c *Config) { c.AllowedNamespaces = []string{"apps"} },
+			wantErr: `namespace "default" is not in allowedNamespaces`},
+		{name: "apply mode", mutate: func(c *Config) { c.Apply.Mode = "patch" },
+			wantErr: `apply.mode "patch" is not supported`},
+		{name: "field manager", mutate: func(c *Config) { c.Apply.FieldManager = "" },
+			wantErr: "apply.fieldManager must not be empty"},
+		{name: "drift policy", mutate: func(c *Config) { c.Drift.Policy = "fix" },
+			wantErr: `drift.policy "fix" is not supported`},
+		{name: "drift interval", mutate: func(c *Config) { c.Drift.Interval = -time.Second },
+			wantErr: "drift.interval must not be negative"},
+		{name: "readiness timeout", mutate: func(c *Config) { c.Readiness.Timeout = -time.Second },
+			wantErr: "readiness.timeout must not be negative"},
+		{name: "readiness interval", mutate: func(c *Config) { c.Readiness.Interval = 0 },
+			wantErr: "readiness.interval must be positive"},
+		{name: "health interval", mutate: func(c *Config) { c.Health.Interval = -time.Second },
+			wantErr: "health.interval must not be negative"},
+		{name: "every error", mutate: func(c *Config) {
+			c.AgentType = ""
+			c.Namespace = ""
+		}, wantErr: "agentType must not be empty; namespace must not be empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			// Load defaults it to the target namespace outside a pod
+			c.Ledger.Namespace = "agent"
+			tt.mutate(c)
+			err := c.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
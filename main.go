@@ -13,21 +13,25 @@ import (
 	"flag"
 	"go.uber.org/zap"
 	"in-cluster/internal/agent"
+	"in-cluster/internal/config"
 	"os"
 	"os/signal"
 )
 
 func main() {
-	var agentType string
-	flag.StringVar(&agentType, "t", "io.opentelemetry.collector", "Agent Type String")
-
-	var agentVersion string
-	flag.StringVar(&agentVersion, "v", "1.0.0", "Agent Version String")
-
-	flag.Parse()
 	sugar := zap.NewExample().Sugar()
 	defer sugar.Sync()
-	opamoAgent := agent.NewAgent(sugar, agentType, agentVersion)
+
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		sugar.Fatalf("Cannot load configuration: %v", err)
+	}
+	sugar.Infof("Effective settings: %s", cfg.Summary())
+
+	opamoAgent, err := agent.NewAgent(sugar, cfg)
+	if err != nil {
+		sugar.Fatalf("Cannot start agent: %v", err)
+	}
 
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"in-cluster/pkg/types"
+	errs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"strings"
+)
+
+type ApplyMode string
+
+const (
+	// ApplyModeUpdate replaces the whole object with a get then update
+	ApplyModeUpdate ApplyMode = "update"
+	// ApplyModeServerSide uses server-side apply, only the fields present in
+	// the payload are owned by the agent
+	ApplyModeServerSide ApplyMode = "server-side"
+)
+
+// DefaultFieldManager is used when Options.FieldManager is not set
+const DefaultFieldManager = "opamp-agent"
+
+// ErrApplyConflict is returned when server-side apply finds fields owned by
+// another manager and conflicts are not forced
+var ErrApplyConflict = errors.New("server-side apply conflict")
+
+// apply creates or patches the object with server-side apply
+func (c *client) apply(appDkube *types.AppDKubernetes, namespace string) (ObjectRef, error) {
+	obj, err := c.applyConfiguration(appDkube, namespace)
+	if err != nil {
+		return ObjectRef{}, err
+	}
+	gvr := gvrOf(appDkube)
+	name := obj.GetName()
+	data, err := json.Marshal(obj.Object)
+	if err != nil {
+		return ObjectRef{}, err
+	}
+	c.logger.Debugf("Applying resource %s %q with field manager %s", gvr.Resource, name, c.fieldManager)
+	force := c.forceConflicts
+	result, err := c.resource(gvr, namespace).Patch(context.TODO(), name, k8stypes.ApplyPatchType, data,
+		metav1.PatchOptions{FieldManager: c.fieldManager, Force: &force})
+	if err != nil {
+		return ObjectRef{}, describeConflict(err, gvr.Resource, name)
+	}
+	c.logger.Debugf("Applied resource: %s", result.GetName())
+	ref := ObjectRef{GVR: gvr, Namespace: namespace, Name: result.GetName()}
+	c.track(ref, obj)
+	return ref, nil
+}
+
+// applyConfiguration builds the object sent with server-side apply
+func (c *client) applyConfiguration(appDkube *types.AppDKubernetes, namespace string) (*unstructured.Unstructured, error) {
+	obj, err := convertOtelCollectorToUnstructured(appDkube)
+	if err != nil {
+		return nil, err
+	}
+	obj.SetNamespace(namespace)
+	c.stamp(obj)
+	// Server owned fields are rejected by server-side apply.
+	obj.SetResourceVersion("")
+	obj.SetManagedFields(nil)
+
+	gvr := gvrOf(appDkube)
+	if obj.GetAPIVersion() == "" {
+		obj.SetAPIVersion(gvr.GroupVersion().String())
+	}
+	if obj.GetKind() == "" {
+		return nil, fmt.Errorf("server-side apply of %s %q requires the object kind", gvr.Resource, obj.GetName())
+	}
+	if obj.GetName() == "" {
+		obj.SetName(appDkube.ResourceInfo.OperationInfo.Name)
+	}
+	return obj, nil
+}
+
+// describeConflict lists the conflicting fields and their managers, as the
+// status message of a conflict only names the first ones
+func describeConflict(err error, resource, name string) error {
+	var statusErr *errs.StatusError
+	if !errs.IsConflict(err) || !errors.As(err, &statusErr) {
+		return err
+	}
+	details := statusErr.Status().Details
+	if details == nil || len(details.Causes) == 0 {
+		return fmt.Errorf("%w on %s %q: %v", ErrApplyConflict, resource, name, err)
+	}
+	conflicts := make([]string, 0, len(details.Causes))
+	for _, cause := range details.Causes {
+		if cause.Type != metav1.CauseTypeFieldManagerConflict {
+			continue
+		}
+		conflicts = append(conflicts, fmt.Sprintf("%s (%s)", cause.Field, cause.Message))
+	}
+	if len(conflicts) == 0 {
+		return fmt.Errorf("%w on %s %q: %v", ErrApplyConflict, resource, name, err)
+	}
+	return fmt.Errorf("%w on %s %q: %s", ErrApplyConflict, resource, name, strings.Join(conflicts, ", "))
+}
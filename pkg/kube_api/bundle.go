@@ -0,0 +1,323 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"in-cluster/pkg/types"
+	"io"
+	errs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"sort"
+	"strings"
+)
+
+// dependencyRanks orders the kinds other resources depend on, resources not
+// listed are workloads or custom resources and go last. Instrumentation is
+// injected when pods are admitted, so it goes before the workloads.
+var dependencyRanks = map[string]int{
+	"namespaces":                0,
+	"customresourcedefinitions": 1,
+	"serviceaccounts":           2,
+	"roles":                     2,
+	"clusterroles":              2,
+	"rolebindings":              2,
+	"clusterrolebindings":       2,
+	"configmaps":                3,
+	"secrets":                   3,
+	"instrumentations":          3,
+}
+
+const (
+	workloadRank       = 4
+	customResourceRank = 5
+)
+
+// dependencyKinds maps the kinds of dependencyRanks to their resource, so
+// manifests can be ordered before they are resolved through discovery
+var dependencyKinds = map[string]string{
+	"Namespace":                "namespaces",
+	"CustomResourceDefinition": "customresourcedefinitions",
+	"ServiceAccount":           "serviceaccounts",
+	"Role":                     "roles",
+	"ClusterRole":              "clusterroles",
+	"RoleBinding":              "rolebindings",
+	"ClusterRoleBinding":       "clusterrolebindings",
+	"ConfigMap":                "configmaps",
+	"Secret":                   "secrets",
+	"Instrumentation":          "instrumentations",
+}
+
+// rollbackStep is an applied bundle member, the object it replaced and the
+// desired state known before it, prior is nil when the member created the object
+type rollbackStep struct {
+	target  ObjectRef
+	prior   *unstructured.Unstructured
+	desired *unstructured.Unstructured
+}
+
+// decodeBundle splits a config file into its resources. A file holds a single
+// resource, a JSON list of resources or YAML documents separated by ---, where
+// each document may be a list as well. Every resource is validated before
+// anything is applied and the error lists all invalid resources.
+func decodeBundle(content []byte, contentType string) ([]*types.AppDKubernetes, error) {
+	docs := [][]byte{content}
+	if contentType == contentTypeYAML {
+		docs = nil
+		reader := yaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(content)))
+		for {
+			doc, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if doc, err = yaml.ToJSON(doc); err != nil {
+				return nil, err
+			}
+			docs = append(docs, doc)
+		}
+	}
+
+	var members []*types.AppDKubernetes
+	for _, doc := range docs {
+		doc = bytes.TrimSpace(doc)
+		switch {
+		case len(doc) == 0 || bytes.Equal(doc, []byte("null")):
+			continue
+		case doc[0] == '[':
+			var items []json.RawMessage
+			if err := json.Unmarshal(doc, &items); err != nil {
+				return nil, err
+			}
+			for _, item := range items {
+				member, err := decodeMember(item)
+				if err != nil {
+					return nil, err
+				}
+				members = append(members, member)
+			}
+		default:
+			member, err := decodeMember(doc)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, member)
+		}
+	}
+	if len(members) == 0 {
+		return nil, errors.New("config file holds no resources")
+	}
+	var invalid []string
+	for i, appDkube := range members {
+		appDkube.Default()
+		if err := appDkube.Validate(); err != nil {
+			invalid = append(invalid, fmt.Sprintf("resource %d: %v", i+1, err))
+		}
+	}
+	if len(invalid) > 0 {
+		return nil, errors.New(strings.Join(invalid, "; "))
+	}
+	return members, nil
+}
+
+func decodeMember(doc []byte) (*types.AppDKubernetes, error) {
+	appDkube := &types.AppDKubernetes{}
+	if err := json.Unmarshal(doc, appDkube); err != nil {
+		return nil, err
+	}
+	if appDkube.Manifest == nil && appDkube.ResourceInfo.GroupVersionResource.Resource == "" {
+		appDkube.Manifest = decodeManifest(doc)
+		if appDkube.Manifest == nil {
+			return nil, errors.New("resource has neither groupVersionResource.resource nor apiVersion and kind")
+		}
+	}
+	return appDkube, nil
+}
+
+// sortBundle puts the members in dependency order. Deletes run after every
+// other member and in reverse order, so dependents are removed first.
+func sortBundle(members []*types.AppDKubernetes) {
+	sort.SliceStable(members, func(i, j int) bool {
+		di := members[i].ResourceInfo.OperationInfo.Operation == types.Delete
+		dj := members[j].ResourceInfo.OperationInfo.Operation == types.Delete
+		if di != dj {
+			return dj
+		}
+		if di {
+			return memberRank(members[i]) > memberRank(members[j])
+		}
+		return memberRank(members[i]) < memberRank(members[j])
+	})
+}
+
+func memberRank(appDkube *types.AppDKubernetes) int {
+	group := appDkube.ResourceInfo.GroupVersionResource.Group
+	resource := string(appDkube.ResourceInfo.GroupVersionResource.Resource)
+	if appDkube.Manifest != nil && resource == "" {
+		gvk := appDkube.Manifest.GroupVersionKind()
+		group, resource = gvk.Group, dependencyKinds[gvk.Kind]
+	}
+	if rank, ok := dependencyRanks[resource]; ok {
+		return rank
+	}
+	// Built-in APIs are served from the core group, single word groups such
+	// as apps or batch, or groups under k8s.io.
+	if group == "" || !strings.Contains(group, ".") || strings.HasSuffix(group, ".k8s.io") {
+		return workloadRank
+	}
+	return customResourceRank
+}
+
+func memberName(appDkube *types.AppDKubernetes) string {
+	if appDkube.Manifest != nil {
+		return fmt.Sprintf("%s %q", appDkube.Manifest.GetKind(), appDkube.Manifest.GetName())
+	}
+	return fmt.Sprintf("%s %q", appDkube.ResourceInfo.GroupVersionResource.Resource,
+		appDkube.ResourceInfo.OperationInfo.Name)
+}
+
+// applyBundle applies the members in dependency order. When the client is
+// atomic a failing member rolls back the members applied before it.
+func (c *client) applyBundle(members []*types.AppDKubernetes) ([]ObjectRef, error) {
+	sortBundle(members)
+	var (
+		refs  []ObjectRef
+		steps []rollbackStep
+	)
+	for _, appDkube := range members {
+		target, err := c.resolve(appDkube)
+		var prior, desired *unstructured.Unstructured
+		if err == nil && c.atomic {
+			desired = c.applied.desiredOf(target)
+			prior, err = c.snapshot(target)
+		}
+		var ref *ObjectRef
+		if err == nil {
+			ref, err = c.orchestrate(appDkube, target.Namespace)
+		}
+		if err != nil {
+			if len(members) > 1 {
+				err = fmt.Errorf("%s: %w", memberName(appDkube), err)
+			}
+			if !c.atomic || len(steps) == 0 {
+				return refs, err
+			}
+			if rbErr := c.rollback(steps); rbErr != nil {
+				return refs, fmt.Errorf("%w, rollback incomplete: %v", err, rbErr)
+			}
+			return nil, fmt.Errorf("%w, rolled back %d applied resources", err, len(steps))
+		}
+
+		if ref != nil {
+			refs = append(refs, *ref)
+			target = *ref
+		}
+		if c.atomic {
+			steps = append(steps, rollbackStep{target: target, prior: prior, desired: desired})
+		}
+		// Custom resources of a CRD in the same bundle are resolved next.
+		if target.GVR.Resource == "customresourcedefinitions" {
+			c.mapper.Reset()
+		}
+	}
+	return refs, nil
+}
+
+// resolve fills in the resource of a manifest and returns the object the
+// member targets
+func (c *client) resolve(appDkube *types.AppDKubernetes) (ObjectRef, error) {
+	if err := c.convertCollector(appDkube); err != nil {
+		return ObjectRef{}, err
+	}
+	if appDkube.Manifest != nil {
+		if err := c.resolveManifest(appDkube); err != nil {
+			return ObjectRef{}, err
+		}
+	}
+	namespace, err := c.namespaceFor(appDkube)
+	if err != nil {
+		return ObjectRef{}, err
+	}
+	return ObjectRef{
+		GVR:       gvrOf(appDkube),
+		Namespace: namespace,
+		Name:      appDkube.ResourceInfo.OperationInfo.Name,
+	}, nil
+}
+
+// snapshot reads the object a member is about to change, nil when it does not
+// exist yet
+func (c *client) snapshot(target ObjectRef) (*unstructured.Unstructured, error) {
+	if target.Name == "" {
+		return nil, nil
+	}
+	obj, err := c.resource(target.GVR, target.Namespace).Get(context.TODO(), target.Name, metav1.GetOptions{})
+	if errs.IsNotFound(err) {
+		return nil, nil
+	}
+	return obj, err
+}
+
+// rollback restores the steps in reverse order and reports the ones it could
+// not restore
+func (c *client) rollback(steps []rollbackStep) error {
+	var failed []string
+	for i := len(steps) - 1; i >= 0; i-- {
+		if err := c.restore(steps[i]); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", steps[i].target.Key(), err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// restore puts the object back the way it was before the bundle, objects the
+// bundle created are deleted
+func (c *client) restore(step rollbackStep) error {
+	resource := c.resource(step.target.GVR, step.target.Namespace)
+	c.logger.Debugf("Rolling back %s", step.target.Key())
+	if step.prior == nil {
+		err := resource.Delete(context.TODO(), step.target.Name, metav1.DeleteOptions{})
+		if err != nil && !errs.IsNotFound(err) {
+			return err
+		}
+		c.applied.remove(step.target)
+		return nil
+	}
+
+	prior := step.prior.DeepCopy()
+	prior.SetManagedFields(nil)
+	current, err := resource.Get(context.TODO(), prior.GetName(), metav1.GetOptions{})
+	switch {
+	case errs.IsNotFound(err):
+		prior.SetResourceVersion("")
+		prior.SetUID("")
+		_, err = resource.Create(context.TODO(), prior, metav1.CreateOptions{FieldManager: c.fieldManager})
+	case err == nil:
+		prior.SetResourceVersion(current.GetResourceVersion())
+		_, err = resource.Update(context.TODO(), prior, metav1.UpdateOptions{FieldManager: c.fieldManager})
+	}
+	if err != nil {
+		return err
+	}
+	c.applied.desire(step.target, step.desired)
+	return nil
+}
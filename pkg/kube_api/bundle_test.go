@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"in-cluster/pkg/types"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeBundle(t *testing.T) {
+	const (
+		deployment = `{"operationInfo":{"name":"app"},"groupVersionResource":{"group":"apps","version":"v1","resource":"deployments"},` +
+			`"deployment":{"metadata":{"name":"app"}}}`
+		service = `{"operationInfo":{"name":"web"},"groupVersionResource":{"version":"v1","resource":"services"},` +
+			`"service":{"metadata":{"name":"web"}}}`
+		widget = `{"apiVersion":"example.com/v1","kind":"Widget","metadata":{"name":"w"}}`
+	)
+	tests := []struct {
+		name        string
+		content     string
+		contentType string
+		want        []string
+		wantErr     string
+	}{
+		{name: "single", content: deployment, contentType: "application/json", want: []string{`deployments "app"`}},
+		{name: "list", content: "[" + deployment + "," + service + "]", contentType: "application/json",
+			want: []string{`deployments "app"`, `services "web"`}},
+		{name: "bare manifest", content: widget, contentType: "application/json", want: []string{`Widget "w"`}},
+		{name: "yaml documents", content: deployment + "\n---\n[" + service + "," + widget + "]\n---\n",
+			contentType: "application/yaml", want: []string{`deployments "app"`, `services "web"`, `Widget "w"`}},
+		{name: "name from the object", content: `{"operationInfo":{"operation":2},` +
+			`"groupVersionResource":{"group":"apps","version":"v1","resource":"deployments"},"deployment":{"metadata":{"name":"app"}}}`,
+			contentType: "application/json", want: []string{`deployments "app"`}},
+		{name: "empty list", content: "[]", contentType: "application/json", wantErr: "config file holds no resources"},
+		{name: "empty yaml", content: "---\n---\n", contentType: "application/yaml", wantErr: "config file holds no resources"},
+		{name: "neither resource nor manifest", content: `{"operationInfo":{"name":"app"}}`, contentType: "application/json",
+			wantErr: "resource has neither groupVersionResource.resource nor apiVersion and kind"},
+		{name: "invalid member", content: "[" + deployment + `,{"operationInfo":{"name":"other"},` +
+			`"groupVersionResource":{"group":"apps","version":"v1","resource":"deployments"},"deployment":{"metadata":{"name":"app"}}}]`,
+			contentType: "application/json", wantErr: `resource 2: invalid resource: metadata.name: "app" does not match`},
+		{name: "invalid json", content: "[" + deployment + ",", contentType: "application/json", wantErr: "unexpected end of JSON input"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			members, err := decodeBundle([]byte(tt.content), tt.contentType)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("decodeBundle() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeBundle() error = %v", err)
+			}
+			var got []string
+			for _, member := range members {
+				got = append(got, memberName(member))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeBundle() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortBundle(t *testing.T) {
+	member := func(name string, group string, resource types.Kind, operation types.Operation) *types.AppDKubernetes {
+		return &types.AppDKubernetes{ResourceInfo: types.ResourceInfo{
+			OperationInfo:        types.OperationInfo{Name: name, Operation: operation},
+			GroupVersionResource: types.GroupVersionResource{Group: group, Version: "v1", Resource: resource},
+		}}
+	}
+	manifest := func(name, apiVersion, kind string) *types.AppDKubernetes {
+		return &types.AppDKubernetes{Manifest: &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": apiVersion, "kind": kind, "metadata": map[string]interface{}{"name": name},
+		}}}
+	}
+	members := []*types.AppDKubernetes{
+		member("widget", "example.com", "widgets", 0),
+		member("old-config", "", "configmaps", types.Delete),
+		member("app", "apps", "deployments", 0),
+		member("old-app", "apps", "deployments", types.Delete),
+		member("config", "", "configmaps", 0),
+		manifest("crd", "apiextensions.k8s.io/v1", "CustomResourceDefinition"),
+		member("agent", "", "serviceaccounts", 0),
+		member("java", "opentelemetry.io", "instrumentations", 0),
+		manifest("apps", "v1", "Namespace"),
+		manifest("policy", "networking.k8s.io/v1", "NetworkPolicy"),
+	}
+	sortBundle(members)
+
+	var got []string
+	for _, m := range members {
+		got = append(got, memberName(m))
+	}
+	want := []string{
+		`Namespace "apps"`,
+		`CustomResourceDefinition "crd"`,
+		`serviceaccounts "agent"`,
+		`configmaps "config"`,
+		`instrumentations "java"`,
+		`deployments "app"`,
+		`NetworkPolicy "policy"`,
+		`widgets "widget"`,
+		`deployments "old-app"`,
+		`configmaps "old-config"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sortBundle() =\n%q\nwant\n%q", got, want)
+	}
+}
@@ -17,50 +17,142 @@ import (
 	"fmt"
 	"go.uber.org/zap"
 	"in-cluster/pkg/types"
-	apiv1 "k8s.io/api/core/v1"
 	errs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 	"net/http"
 	"path/filepath"
-	"strings"
+	"time"
 )
 
+// ErrOperationConflict is returned when an explicit Create or Update does not
+// match the state of the cluster
+var ErrOperationConflict = errors.New("operation conflicts with cluster state")
+
 type K8sAPIClient interface {
-	Orchestrate(content []byte, contentType string) error
+	// Orchestrate applies the config file, or previews it when dry run is on
+	Orchestrate(content []byte, contentType string) (Result, error)
+	Store(kind StoreKind, namespace, name string) Store
+	ClusterUID(ctx context.Context) (string, error)
+	EffectiveConfig(ctx context.Context) (map[string][]byte, error)
+	// Track registers objects applied by a previous run of the agent
+	Track(refs []ObjectRef)
+	// Restore rebuilds the desired state of the objects a config file applied
+	// in a previous run of the agent, nothing is written to the cluster
+	Restore(content []byte, contentType string) error
+	// Reconcile detects and handles drift of the applied objects until ctx is done
+	Reconcile(ctx context.Context, opts ReconcileOptions, report func(Drift))
+	// WatchHealth reports the health of the applied objects whenever it changes,
+	// until ctx is done
+	WatchHealth(ctx context.Context, interval time.Duration, report func([]ObjectHealth))
+	// WaitReady waits until the objects finished rolling out
+	WaitReady(ctx context.Context, refs []ObjectRef, opts ReadinessOptions) error
+	// Prune deletes agent owned objects that are no longer desired
+	Prune(ctx context.Context, refs []ObjectRef, dryRun bool) ([]ObjectRef, error)
+}
+
+// Options configures how the client orchestrates resources
+type Options struct {
+	// Namespace used when neither the resource info nor the object sets one
+	Namespace string
+	// AllowedNamespaces the client may touch, any namespace when empty
+	AllowedNamespaces []string
+	// AllowClusterScoped permits cluster scoped kinds while AllowedNamespaces
+	// is set, they are always permitted without it
+	AllowClusterScoped bool
+	// ApplyMode used for updates, ApplyModeUpdate when not set
+	ApplyMode ApplyMode
+	// FieldManager recorded on every write, DefaultFieldManager when not set
+	FieldManager string
+	// ForceConflicts takes over fields owned by other managers on server-side apply
+	ForceConflicts bool
+	// Atomic rolls back the applied members of a bundle when a later one fails
+	Atomic bool
+	// DryRun previews every config file, as DryRunAnnotation does for one
+	DryRun bool
+	// LegacyPayloads unescapes payloads without an envelope the way the first
+	// servers escaped them
+	LegacyPayloads bool
 }
 
 type client struct {
 	cf            *rest.Config
 	logger        *zap.SugaredLogger
 	dynamicClient dynamic.Interface
+	mapper        meta.ResettableRESTMapper
+	namespace     string
+	allowed       map[string]struct{}
+	allowCluster  bool
+	applied       appliedSet
+
+	applyMode      ApplyMode
+	fieldManager   string
+	forceConflicts bool
+	atomic         bool
+	dryRun         bool
+	legacyPayloads bool
 }
 
-// NewClient run from a K8s cluster
-func NewClient(logger *zap.SugaredLogger) K8sAPIClient {
-	cf, err := rest.InClusterConfig()
+func newClient(logger *zap.SugaredLogger, cf *rest.Config, opts Options) (*client, error) {
+	dynamicClient, err := dynamic.NewForConfig(cf)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	dynamicClient, err := dynamic.NewForConfig(cf)
+	mapper, err := newRESTMapper(cf)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return &client{
+	c := &client{
 		cf:            cf,
 		logger:        logger,
 		dynamicClient: dynamicClient,
+		mapper:        mapper,
+		namespace:     opts.Namespace,
+		allowCluster:  opts.AllowClusterScoped,
+
+		applyMode:      opts.ApplyMode,
+		fieldManager:   opts.FieldManager,
+		forceConflicts: opts.ForceConflicts,
+		atomic:         opts.Atomic,
+		dryRun:         opts.DryRun,
+		legacyPayloads: opts.LegacyPayloads,
+	}
+	if c.applyMode == "" {
+		c.applyMode = ApplyModeUpdate
+	}
+	if c.fieldManager == "" {
+		c.fieldManager = DefaultFieldManager
+	}
+	if len(opts.AllowedNamespaces) > 0 {
+		c.allowed = make(map[string]struct{}, len(opts.AllowedNamespaces))
+		for _, ns := range opts.AllowedNamespaces {
+			c.allowed[ns] = struct{}{}
+		}
+	}
+	return c, nil
+}
+
+// NewClient run from a K8s cluster
+func NewClient(logger *zap.SugaredLogger, opts Options) K8sAPIClient {
+	cf, err := rest.InClusterConfig()
+	if err != nil {
+		panic(err)
+	}
+	c, err := newClient(logger, cf, opts)
+	if err != nil {
+		panic(err)
 	}
+	return c
 }
 
 // NewClient2 run from a Local env
-func NewClient2(logger *zap.SugaredLogger) K8sAPIClient {
+func NewClient2(logger *zap.SugaredLogger, opts Options) K8sAPIClient {
 	var kubeconfig *string
 	if home := homedir.HomeDir(); home != "" {
 		kubeconfig = flag.String("kubeconfig1", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
@@ -73,70 +165,149 @@ func NewClient2(logger *zap.SugaredLogger) K8sAPIClient {
 	if err != nil {
 		panic(err)
 	}
-	dynamicClient, err := dynamic.NewForConfig(cf)
+	c, err := newClient(logger, cf, opts)
 	if err != nil {
 		panic(err)
 	}
-	return &client{
-		cf:            cf,
-		logger:        logger,
-		dynamicClient: dynamicClient,
+	return c
+}
+
+func (c *client) Orchestrate(content []byte, contentType string) (Result, error) {
+	members, err := c.decode(content, contentType)
+	if err != nil {
+		return Result{}, err
+	}
+	if c.dryRun || dryRunRequested(members) {
+		changes, err := c.plan(members)
+		return Result{DryRun: true, Changes: changes}, err
 	}
+	objects, err := c.applyBundle(members)
+	return Result{Objects: objects}, err
 }
 
-func (c *client) Orchestrate(content []byte, contentType string) error {
+// decode opens the config file and returns its validated resources
+func (c *client) decode(content []byte, contentType string) ([]*types.AppDKubernetes, error) {
+	content, contentType, err := normalizeContent(content, contentType)
+	if err != nil {
+		return nil, err
+	}
+	content, contentType, enveloped, err := openEnvelope(content, contentType)
+	if err != nil {
+		return nil, err
+	}
+	if !enveloped && c.legacyPayloads {
+		content = legacyUnescape(content)
+	}
+	return decodeBundle(content, contentType)
+}
+
+// orchestrate applies a single resolved resource, deletes return no ref
+func (c *client) orchestrate(appDkube *types.AppDKubernetes, namespace string) (*ObjectRef, error) {
 	var (
-		appDkube types.AppDKubernetes
-		err      error
+		ref ObjectRef
+		err error
 	)
-	// TODO - Just for POC
-	if !strings.Contains(string(content), "opentelemetrycollectors") {
-		content = []byte(strings.ReplaceAll(string(content), `\"`, `"`))
-		content = []byte(strings.ReplaceAll(string(content), `\n`, ``))
-		content = []byte(strings.ReplaceAll(string(content), `"{`, `{`))
-		content = []byte(strings.ReplaceAll(string(content), `}"`, `}`))
-	}
-	switch contentType {
-	case "application/json":
-		if err = json.Unmarshal(content, &appDkube); err != nil {
-			return err
+	switch appDkube.ResourceInfo.OperationInfo.Operation {
+	case types.Delete:
+		return nil, c.delete(appDkube, namespace)
+	case types.Create:
+		ref, err = c.create(appDkube, namespace)
+		if errs.IsAlreadyExists(err) {
+			return nil, fmt.Errorf("%w: cannot create %s %q, it already exists", ErrOperationConflict,
+				appDkube.ResourceInfo.GroupVersionResource.Resource, appDkube.ResourceInfo.OperationInfo.Name)
 		}
-	case "application/yaml":
-		if err = yaml.Unmarshal(content, &appDkube); err != nil {
-			return err
+	case types.Update:
+		ref, err = c.updateExisting(appDkube, namespace)
+	case 0:
+		if c.applyMode == ApplyModeServerSide {
+			ref, err = c.apply(appDkube, namespace)
+		} else {
+			ref, err = c.createOrUpdate(appDkube, namespace)
 		}
+	default:
+		return nil, fmt.Errorf("unknown operation %d", appDkube.ResourceInfo.OperationInfo.Operation)
+	}
+	if err != nil {
+		return nil, err
 	}
+	return &ref, nil
+}
+
+func (c *client) createOrUpdate(appDkube *types.AppDKubernetes, namespace string) (ObjectRef, error) {
 	var statusErr *errs.StatusError
-	deployed, err := c.get(&appDkube, appDkube.ResourceInfo.OperationInfo.Name)
+	deployed, err := c.get(appDkube, namespace, appDkube.ResourceInfo.OperationInfo.Name)
 	switch {
 	case errors.As(err, &statusErr):
 		if statusErr.Status().Code != http.StatusNotFound {
-			return statusErr
-		}
-		if e := c.create(&appDkube); e != nil {
-			return e
+			return ObjectRef{}, statusErr
 		}
+		return c.create(appDkube, namespace)
 	case err != nil:
-		return err
+		return ObjectRef{}, err
 	default:
 		metaData, e := extractMetadata(deployed)
 		if e != nil {
-			return e
-		}
-		if e = c.update(&appDkube, metaData); e != nil {
-			return e
+			return ObjectRef{}, e
 		}
+		return c.update(appDkube, namespace, metaData)
 	}
+}
 
+func (c *client) updateExisting(appDkube *types.AppDKubernetes, namespace string) (ObjectRef, error) {
+	deployed, err := c.get(appDkube, namespace, appDkube.ResourceInfo.OperationInfo.Name)
+	if errs.IsNotFound(err) {
+		return ObjectRef{}, fmt.Errorf("%w: cannot update %s %q, it does not exist", ErrOperationConflict,
+			appDkube.ResourceInfo.GroupVersionResource.Resource, appDkube.ResourceInfo.OperationInfo.Name)
+	}
+	if err != nil {
+		return ObjectRef{}, err
+	}
+	if c.applyMode == ApplyModeServerSide {
+		return c.apply(appDkube, namespace)
+	}
+	metaData, err := extractMetadata(deployed)
+	if err != nil {
+		return ObjectRef{}, err
+	}
+	return c.update(appDkube, namespace, metaData)
+}
+
+// delete removes the resource, a resource that is already gone counts as deleted
+func (c *client) delete(appDkube *types.AppDKubernetes, namespace string) error {
+	info := appDkube.ResourceInfo.OperationInfo
+	if p := info.PropagationPolicy; p != nil {
+		switch *p {
+		case metav1.DeletePropagationForeground, metav1.DeletePropagationBackground, metav1.DeletePropagationOrphan:
+		default:
+			return fmt.Errorf("unknown propagation policy %q", *p)
+		}
+	}
+	c.logger.Debugf("Delete Resource: %s", info.Name)
+	deploymentRes := schema.GroupVersionResource{
+		Group:    appDkube.ResourceInfo.GroupVersionResource.Group,
+		Version:  appDkube.ResourceInfo.GroupVersionResource.Version,
+		Resource: string(appDkube.ResourceInfo.GroupVersionResource.Resource),
+	}
+	err := c.resource(deploymentRes, namespace).Delete(context.TODO(), info.Name, metav1.DeleteOptions{
+		PropagationPolicy:  info.PropagationPolicy,
+		GracePeriodSeconds: info.GracePeriodSeconds,
+	})
+	if err != nil && !errs.IsNotFound(err) {
+		return err
+	}
+	c.applied.remove(ObjectRef{GVR: deploymentRes, Namespace: namespace, Name: info.Name})
+	c.logger.Debugf("Deleted resource: %s", info.Name)
 	return nil
 }
 
-func (c *client) create(otelCol *types.AppDKubernetes) error {
+func (c *client) create(otelCol *types.AppDKubernetes, namespace string) (ObjectRef, error) {
 
 	deployment, err := convertOtelCollectorToUnstructured(otelCol)
 	if err != nil {
-		return err
+		return ObjectRef{}, err
 	}
+	deployment.SetNamespace(namespace)
+	c.stamp(deployment)
 	// Create Deployment
 	c.logger.Debug("Creating deployment...")
 	deploymentRes := schema.GroupVersionResource{
@@ -144,44 +315,108 @@ func (c *client) create(otelCol *types.AppDKubernetes) error {
 		Version:  otelCol.ResourceInfo.GroupVersionResource.Version,
 		Resource: string(otelCol.ResourceInfo.GroupVersionResource.Resource),
 	}
-	result, err := c.dynamicClient.Resource(deploymentRes).
-		Namespace(apiv1.NamespaceDefault).
-		Create(context.TODO(), deployment, metav1.CreateOptions{})
+	result, err := c.resource(deploymentRes, namespace).
+		Create(context.TODO(), deployment, metav1.CreateOptions{FieldManager: c.fieldManager})
 	if err != nil {
-		return err
+		return ObjectRef{}, err
 	}
 	c.logger.Debugf("Created deployment %q.\n", result.GetName())
-	return nil
+	ref := ObjectRef{GVR: deploymentRes, Namespace: namespace, Name: result.GetName()}
+	c.track(ref, deployment)
+	return ref, nil
 }
 
-func (c *client) update(otelCol *types.AppDKubernetes, metadata interface{}) error {
+func (c *client) update(otelCol *types.AppDKubernetes, namespace string, metadata interface{}) (ObjectRef, error) {
 	c.logger.Debug("Update Resource")
 	deploymentUpdate, err := convertOtelCollectorToUnstructured(otelCol)
 	if err != nil {
-		return nil
+		return ObjectRef{}, err
 	}
+	deploymentUpdate.SetNamespace(namespace)
+	c.stamp(deploymentUpdate)
+	// The desired state is the payload, the live metadata merged below carries
+	// annotations of other controllers that would read as drift
+	desired := deploymentUpdate.DeepCopy()
 	deploymentUpdate.Object["metadata"] = mergeMetadata(deploymentUpdate.Object["metadata"], metadata)
 	deploymentRes := schema.GroupVersionResource{
 		Group:    otelCol.ResourceInfo.GroupVersionResource.Group,
 		Version:  otelCol.ResourceInfo.GroupVersionResource.Version,
 		Resource: string(otelCol.ResourceInfo.GroupVersionResource.Resource),
 	}
-	result, err := c.dynamicClient.Resource(deploymentRes).
-		Namespace(apiv1.NamespaceDefault).
-		Update(context.TODO(), deploymentUpdate, metav1.UpdateOptions{})
+	result, err := c.resource(deploymentRes, namespace).
+		Update(context.TODO(), deploymentUpdate, metav1.UpdateOptions{FieldManager: c.fieldManager})
+	if err != nil {
+		return ObjectRef{}, err
+	}
 	c.logger.Debugf("Updated deployment: %s", result.GetName())
+	ref := ObjectRef{GVR: deploymentRes, Namespace: namespace, Name: result.GetName()}
+	c.track(ref, desired)
 
-	return err
+	return ref, nil
 }
 
-func (c *client) get(otelCol *types.AppDKubernetes, name string) (*unstructured.Unstructured, error) {
+func (c *client) get(otelCol *types.AppDKubernetes, namespace, name string) (*unstructured.Unstructured, error) {
 	c.logger.Debugf("Get Resource: %s", name)
 	deploymentRes := schema.GroupVersionResource{
 		Group:    otelCol.ResourceInfo.GroupVersionResource.Group,
 		Version:  otelCol.ResourceInfo.GroupVersionResource.Version,
 		Resource: string(otelCol.ResourceInfo.GroupVersionResource.Resource),
 	}
-	return c.dynamicClient.Resource(deploymentRes).Namespace(apiv1.NamespaceDefault).Get(context.TODO(), name, metav1.GetOptions{})
+	return c.resource(deploymentRes, namespace).Get(context.TODO(), name, metav1.GetOptions{})
+}
+
+// namespaceFor resolves the namespace of the resource from, in order, the
+// resource info, the object metadata and the client default. Cluster scoped
+// kinds have no namespace.
+func (c *client) namespaceFor(appDkube *types.AppDKubernetes) (string, error) {
+	resource := appDkube.ResourceInfo.GroupVersionResource.Resource
+	if c.clusterScoped(gvrOf(appDkube)) {
+		if appDkube.ResourceInfo.Namespace != "" {
+			return "", fmt.Errorf("%s are cluster scoped, namespace %q is not allowed", resource, appDkube.ResourceInfo.Namespace)
+		}
+		// The allowlist confines the agent, objects outside any namespace escape it
+		if c.allowed != nil && !c.allowCluster {
+			return "", fmt.Errorf("%s are cluster scoped, allowedNamespaces is set and allowClusterScoped is not", resource)
+		}
+		return "", nil
+	}
+
+	var objectNamespace string
+	if obj, err := convertOtelCollectorToUnstructured(appDkube); err == nil && obj.Object != nil {
+		objectNamespace = obj.GetNamespace()
+	}
+	namespace := appDkube.ResourceInfo.Namespace
+	switch {
+	case namespace == "":
+		namespace = objectNamespace
+	case objectNamespace != "" && objectNamespace != namespace:
+		return "", fmt.Errorf("namespace %q does not match the object namespace %q", namespace, objectNamespace)
+	}
+	if namespace == "" {
+		namespace = c.namespace
+	}
+
+	if c.allowed != nil {
+		if _, ok := c.allowed[namespace]; !ok {
+			return "", fmt.Errorf("namespace %q is not in the allowed namespaces", namespace)
+		}
+	}
+	return namespace, nil
+}
+
+func gvrOf(appDkube *types.AppDKubernetes) schema.GroupVersionResource {
+	return schema.GroupVersionResource{
+		Group:    appDkube.ResourceInfo.GroupVersionResource.Group,
+		Version:  appDkube.ResourceInfo.GroupVersionResource.Version,
+		Resource: string(appDkube.ResourceInfo.GroupVersionResource.Resource),
+	}
+}
+
+func (c *client) resource(gvr schema.GroupVersionResource, namespace string) dynamic.ResourceInterface {
+	if namespace == "" {
+		return c.dynamicClient.Resource(gvr)
+	}
+	return c.dynamicClient.Resource(gvr).Namespace(namespace)
 }
 
 func convertOtelCollectorToUnstructured(otelCol *types.AppDKubernetes) (*unstructured.Unstructured, error) {
@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"fmt"
+	"github.com/open-telemetry/opentelemetry-operator/apis/v1alpha1"
+	"in-cluster/pkg/types"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	collectorV1alpha1 = "v1alpha1"
+	collectorV1beta1  = "v1beta1"
+)
+
+var collectorKind = schema.GroupKind{Group: v1alpha1.GroupVersion.Group, Kind: "OpenTelemetryCollector"}
+
+// convertCollector turns the typed v1alpha1 collector into a v1beta1 manifest
+// when the payload asks for v1beta1, or when the operator no longer serves
+// v1alpha1 but serves v1beta1. Other members are left alone.
+func (c *client) convertCollector(appDkube *types.AppDKubernetes) error {
+	gvr := &appDkube.ResourceInfo.GroupVersionResource
+	if appDkube.Manifest != nil || gvr.Resource != types.OpenTelemetryCollectors {
+		return nil
+	}
+	if gvr.Version == collectorV1alpha1 {
+		served := c.servedVersions(collectorKind)
+		if served[collectorV1alpha1] || !served[collectorV1beta1] {
+			return nil
+		}
+		c.logger.Infof("Operator no longer serves %s/%s, applying collector %q as %s", gvr.Group,
+			collectorV1alpha1, appDkube.ResourceInfo.OperationInfo.Name, collectorV1beta1)
+	}
+	gvr.Version = collectorV1beta1
+
+	if appDkube.KubernetesCRD == nil || appDkube.KubernetesCRD.OpenTelemetryCollector == nil {
+		// A delete without the object only needs the version
+		return nil
+	}
+	obj, err := convertOtelCollectorToUnstructured(appDkube)
+	if err != nil {
+		return err
+	}
+	if err := collectorToV1beta1(obj); err != nil {
+		return fmt.Errorf("converting collector %q to %s: %w", obj.GetName(), collectorV1beta1, err)
+	}
+	appDkube.KubernetesCRD.OpenTelemetryCollector = nil
+	appDkube.Manifest = obj
+	return nil
+}
+
+// servedVersions lists the versions the API server serves for the kind. The
+// discovery cache is only reset when it does not know the kind, like manifests
+// are resolved.
+func (c *client) servedVersions(kind schema.GroupKind) map[string]bool {
+	served := make(map[string]bool)
+	if c.mapper == nil {
+		return served
+	}
+	mappings, err := c.mapper.RESTMappings(kind)
+	if meta.IsNoMatchError(err) {
+		c.mapper.Reset()
+		mappings, err = c.mapper.RESTMappings(kind)
+	}
+	if err != nil {
+		c.logger.Debugf("Cannot resolve versions of %s: %v", kind, err)
+		return served
+	}
+	for _, mapping := range mappings {
+		served[mapping.Resource.Version] = true
+	}
+	return served
+}
+
+// collectorToV1beta1 rewrites a v1alpha1 collector in the v1beta1 schema: the
+// config string becomes an object and maxReplicas moves to the autoscaler.
+// Fields with the same path in both versions are kept as they are.
+func collectorToV1beta1(obj *unstructured.Unstructured) error {
+	obj.SetAPIVersion(schema.GroupVersion{Group: collectorKind.Group, Version: collectorV1beta1}.String())
+	obj.SetKind(collectorKind.Kind)
+	delete(obj.Object, "status")
+
+	spec, _, err := unstructured.NestedMap(obj.Object, "spec")
+	if err != nil {
+		return err
+	}
+	if spec == nil {
+		spec = map[string]interface{}{}
+	}
+	if raw, ok := spec["config"].(string); ok {
+		var config map[string]interface{}
+		if err := yaml.Unmarshal([]byte(raw), &config); err != nil {
+			return fmt.Errorf("spec.config is not valid YAML: %w", err)
+		}
+		spec["config"] = config
+	}
+	if maxReplicas, ok := spec["maxReplicas"]; ok {
+		autoscaler := map[string]interface{}{"maxReplicas": maxReplicas}
+		if replicas, ok := spec["replicas"]; ok {
+			autoscaler["minReplicas"] = replicas
+		}
+		spec["autoscaler"] = autoscaler
+		delete(spec, "maxReplicas")
+	}
+	// v1alpha1 always sends the strategy, v1beta1 rejects an empty one
+	if spec["upgradeStrategy"] == "" {
+		delete(spec, "upgradeStrategy")
+	}
+	return unstructured.SetNestedMap(obj.Object, spec, "spec")
+}
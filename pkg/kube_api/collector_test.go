@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"reflect"
+	"testing"
+)
+
+func TestCollectorToV1beta1(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    map[string]interface{}
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name: "config string",
+			spec: map[string]interface{}{"mode": "deployment", "config": "receivers:\n  otlp: {}\n"},
+			want: map[string]interface{}{"mode": "deployment",
+				"config": map[string]interface{}{"receivers": map[string]interface{}{"otlp": map[string]interface{}{}}}},
+		},
+		{
+			name: "max replicas",
+			spec: map[string]interface{}{"replicas": int64(2), "maxReplicas": int64(5)},
+			want: map[string]interface{}{"replicas": int64(2),
+				"autoscaler": map[string]interface{}{"minReplicas": int64(2), "maxReplicas": int64(5)}},
+		},
+		{
+			name: "max replicas without replicas",
+			spec: map[string]interface{}{"maxReplicas": int64(5)},
+			want: map[string]interface{}{"autoscaler": map[string]interface{}{"maxReplicas": int64(5)}},
+		},
+		{
+			name: "empty upgrade strategy",
+			spec: map[string]interface{}{"upgradeStrategy": "", "image": "otel"},
+			want: map[string]interface{}{"image": "otel"},
+		},
+		{
+			name: "upgrade strategy",
+			spec: map[string]interface{}{"upgradeStrategy": "none"},
+			want: map[string]interface{}{"upgradeStrategy": "none"},
+		},
+		{
+			name: "no spec",
+			want: map[string]interface{}{},
+		},
+		{
+			name:    "invalid config",
+			spec:    map[string]interface{}{"config": "receivers: ["},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "opentelemetry.io/v1alpha1",
+				"kind":       "OpenTelemetryCollector",
+				"metadata":   map[string]interface{}{"name": "otel"},
+				"status":     map[string]interface{}{"version": "0.1"},
+			}}
+			if tt.spec != nil {
+				obj.Object["spec"] = tt.spec
+			}
+			err := collectorToV1beta1(obj)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("collectorToV1beta1() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("collectorToV1beta1() error = %v", err)
+			}
+			if obj.GetAPIVersion() != "opentelemetry.io/v1beta1" || obj.GetKind() != "OpenTelemetryCollector" {
+				t.Errorf("collectorToV1beta1() is %s %s", obj.GetAPIVersion(), obj.GetKind())
+			}
+			if _, ok := obj.Object["status"]; ok {
+				t.Error("collectorToV1beta1() kept the status")
+			}
+			if got := obj.Object["spec"]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("collectorToV1beta1() spec = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
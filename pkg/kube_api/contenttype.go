@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+)
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeYAML = "application/yaml"
+)
+
+// maxDecompressedSize bounds gzip bodies, a config file is stored in a
+// ConfigMap and cannot be larger anyway
+const maxDecompressedSize = 16 << 20
+
+// ErrUnsupportedContentType is returned for config files the client cannot decode
+var ErrUnsupportedContentType = errors.New("unsupported content type")
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// normalizeContent decompresses gzip bodies and maps the content type to
+// application/json or application/yaml. Parameters other than a UTF-8 charset
+// are ignored, an empty content type is sniffed from the body.
+func normalizeContent(content []byte, contentType string) ([]byte, string, error) {
+	mediaType := ""
+	if strings.TrimSpace(contentType) != "" {
+		var (
+			params map[string]string
+			err    error
+		)
+		mediaType, params, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w %q: %v", ErrUnsupportedContentType, contentType, err)
+		}
+		if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") &&
+			!strings.EqualFold(charset, "us-ascii") {
+			return nil, "", fmt.Errorf("%w %q: only UTF-8 is supported", ErrUnsupportedContentType, contentType)
+		}
+	}
+
+	compressed := bytes.HasPrefix(content, gzipMagic)
+	switch {
+	case mediaType == "application/gzip" || mediaType == "application/x-gzip":
+		compressed, mediaType = true, ""
+	case strings.HasSuffix(mediaType, "+gzip"):
+		compressed, mediaType = true, strings.TrimSuffix(mediaType, "+gzip")
+	}
+	if compressed {
+		var err error
+		if content, err = gunzip(content); err != nil {
+			return nil, "", err
+		}
+	}
+
+	switch {
+	case mediaType == "":
+		return sniffContent(content)
+	case mediaType == contentTypeJSON || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json"):
+		return content, contentTypeJSON, nil
+	case mediaType == contentTypeYAML || mediaType == "application/x-yaml" || mediaType == "text/yaml" ||
+		mediaType == "text/x-yaml" || strings.HasSuffix(mediaType, "+yaml"):
+		return content, contentTypeYAML, nil
+	default:
+		return nil, "", fmt.Errorf("%w %q, use %s or %s", ErrUnsupportedContentType, contentType,
+			contentTypeJSON, contentTypeYAML)
+	}
+}
+
+// sniffContent treats valid JSON as JSON and anything else as YAML
+func sniffContent(content []byte) ([]byte, string, error) {
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) == 0 {
+		return nil, "", errors.New("config file is empty")
+	}
+	if (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+		return content, contentTypeJSON, nil
+	}
+	return content, contentTypeYAML, nil
+}
+
+func gunzip(content []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing config file: %w", err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(io.LimitReader(reader, maxDecompressedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing config file: %w", err)
+	}
+	if len(data) > maxDecompressedSize {
+		return nil, fmt.Errorf("decompressed config file exceeds %d bytes", maxDecompressedSize)
+	}
+	return data, nil
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+)
+
+func gzipped(t *testing.T, content string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNormalizeContent(t *testing.T) {
+	const jsonBody, yamlBody = `{"kind":"ConfigMap"}`, "kind: ConfigMap\n"
+	tests := []struct {
+		name        string
+		content     []byte
+		contentType string
+		want        string
+		wantType    string
+		wantErr     error
+	}{
+		{name: "json", content: []byte(jsonBody), contentType: "application/json", want: jsonBody, wantType: contentTypeJSON},
+		{name: "text json", content: []byte(jsonBody), contentType: "text/json", want: jsonBody, wantType: contentTypeJSON},
+		{name: "json suffix", content: []byte(jsonBody), contentType: "application/vnd.appd+json", want: jsonBody,
+			wantType: contentTypeJSON},
+		{name: "json utf-8", content: []byte(jsonBody), contentType: "application/json; charset=UTF-8", want: jsonBody,
+			wantType: contentTypeJSON},
+		{name: "yaml", content: []byte(yamlBody), contentType: "application/yaml", want: yamlBody, wantType: contentTypeYAML},
+		{name: "x-yaml", content: []byte(yamlBody), contentType: "application/x-yaml", want: yamlBody,
+			wantType: contentTypeYAML},
+		{name: "text yaml", content: []byte(yamlBody), contentType: "text/yaml", want: yamlBody, wantType: contentTypeYAML},
+		{name: "sniffed json", content: []byte(jsonBody), want: jsonBody, wantType: contentTypeJSON},
+		{name: "sniffed yaml", content: []byte(yamlBody), want: yamlBody, wantType: contentTypeYAML},
+		{name: "sniffed invalid json is yaml", content: []byte("{kind: ConfigMap}"), want: "{kind: ConfigMap}",
+			wantType: contentTypeYAML},
+		{name: "gzip content type", content: gzipped(t, jsonBody), contentType: "application/gzip", want: jsonBody,
+			wantType: contentTypeJSON},
+		{name: "gzip suffix", content: gzipped(t, yamlBody), contentType: "application/yaml+gzip", want: yamlBody,
+			wantType: contentTypeYAML},
+		{name: "gzip magic", content: gzipped(t, yamlBody), contentType: "application/yaml", want: yamlBody,
+			wantType: contentTypeYAML},
+		{name: "unsupported type", content: []byte(jsonBody), contentType: "text/plain",
+			wantErr: ErrUnsupportedContentType},
+		{name: "unsupported charset", content: []byte(jsonBody), contentType: "application/json; charset=latin1",
+			wantErr: ErrUnsupportedContentType},
+		{name: "malformed type", content: []byte(jsonBody), contentType: "application/json;;", wantErr: ErrUnsupportedContentType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotType, err := normalizeContent(tt.content, tt.contentType)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("normalizeContent() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("normalizeContent() error = %v", err)
+			}
+			if string(got) != tt.want || gotType != tt.wantType {
+				t.Errorf("normalizeContent() = %q, %q, want %q, %q", got, gotType, tt.want, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestNormalizeContentEmpty(t *testing.T) {
+	if _, _, err := normalizeContent([]byte("  \n"), ""); err == nil {
+		t.Error("normalizeContent() of an empty file succeeded")
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"in-cluster/pkg/types"
+	errs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// DryRunAnnotation set to "true" on any resource of a config file previews
+// the whole file instead of applying it
+const DryRunAnnotation = "opamp.appdynamics.com/dry-run"
+
+// Action a config file would take on an object
+type Action string
+
+const (
+	ActionCreate Action = "create"
+	ActionUpdate Action = "update"
+	ActionDelete Action = "delete"
+	ActionNone   Action = "none"
+)
+
+// Change previews what a resource of a config file would do to the cluster
+type Change struct {
+	Object ObjectRef     `json:"object"`
+	Action Action        `json:"action,omitempty"`
+	Fields []FieldChange `json:"fields,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// FieldChange is a field whose live value differs from the one the server
+// would store, a missing side is nil
+type FieldChange struct {
+	Path    string      `json:"path"`
+	Live    interface{} `json:"live,omitempty"`
+	Desired interface{} `json:"desired,omitempty"`
+}
+
+// Result of orchestrating a config file
+type Result struct {
+	// Objects the config file applied, empty for a dry run
+	Objects []ObjectRef
+	// DryRun is set when nothing was changed and Changes previews the file
+	DryRun  bool
+	Changes []Change
+}
+
+// dryRunRequested reports whether any member carries the dry-run annotation
+func dryRunRequested(members []*types.AppDKubernetes) bool {
+	for _, appDkube := range members {
+		obj, err := convertOtelCollectorToUnstructured(appDkube)
+		if err != nil || obj.Object == nil {
+			continue
+		}
+		if strings.EqualFold(obj.GetAnnotations()[DryRunAnnotation], "true") {
+			return true
+		}
+	}
+	return false
+}
+
+// plan runs every member as a server-side dry run in dependency order. Every
+// member is planned, the error names the ones the server rejected.
+func (c *client) plan(members []*types.AppDKubernetes) ([]Change, error) {
+	sortBundle(members)
+	changes := make([]Change, 0, len(members))
+	var failed []string
+	for _, appDkube := range members {
+		change, err := c.planMember(context.TODO(), appDkube)
+		if err != nil {
+			change.Error = err.Error()
+			failed = append(failed, fmt.Sprintf("%s: %v", memberName(appDkube), err))
+		}
+		changes = append(changes, change)
+	}
+	if len(failed) > 0 {
+		return changes, fmt.Errorf("dry run failed for %d of %d resources: %s",
+			len(failed), len(members), strings.Join(failed, "; "))
+	}
+	return changes, nil
+}
+
+func (c *client) planMember(ctx context.Context, appDkube *types.AppDKubernetes) (Change, error) {
+	target, err := c.resolve(appDkube)
+	change := Change{Object: target}
+	if err != nil {
+		return change, err
+	}
+	resource := c.resource(target.GVR, target.Namespace)
+	live, err := resource.Get(ctx, target.Name, metav1.GetOptions{})
+	switch {
+	case errs.IsNotFound(err):
+		live = nil
+	case err != nil:
+		return change, err
+	}
+
+	dryRun := []string{metav1.DryRunAll}
+	info := appDkube.ResourceInfo.OperationInfo
+	switch info.Operation {
+	case types.Delete:
+		if live == nil {
+			change.Action = ActionNone
+			return change, nil
+		}
+		change.Action = ActionDelete
+		return change, resource.Delete(ctx, target.Name, metav1.DeleteOptions{
+			DryRun:             dryRun,
+			PropagationPolicy:  info.PropagationPolicy,
+			GracePeriodSeconds: info.GracePeriodSeconds,
+		})
+	case types.Create:
+		if live != nil {
+			return change, fmt.Errorf("%w: cannot create %s %q, it already exists", ErrOperationConflict,
+				target.GVR.Resource, target.Name)
+		}
+	case types.Update:
+		if live == nil {
+			return change, fmt.Errorf("%w: cannot update %s %q, it does not exist", ErrOperationConflict,
+				target.GVR.Resource, target.Name)
+		}
+	}
+
+	var result *unstructured.Unstructured
+	if c.applyMode == ApplyModeServerSide {
+		obj, err := c.applyConfiguration(appDkube, target.Namespace)
+		if err != nil {
+			return change, err
+		}
+		data, err := json.Marshal(obj.Object)
+		if err != nil {
+			return change, err
+		}
+		force := c.forceConflicts
+		result, err = resource.Patch(ctx, obj.GetName(), k8stypes.ApplyPatchType, data,
+			metav1.PatchOptions{FieldManager: c.fieldManager, Force: &force, DryRun: dryRun})
+		if err != nil {
+			return change, describeConflict(err, target.GVR.Resource, obj.GetName())
+		}
+	} else {
+		obj, err := convertOtelCollectorToUnstructured(appDkube)
+		if err != nil {
+			return change, err
+		}
+		obj.SetNamespace(target.Namespace)
+		if live == nil {
+			c.stamp(obj)
+			result, err = resource.Create(ctx, obj, metav1.CreateOptions{FieldManager: c.fieldManager, DryRun: dryRun})
+		} else {
+			obj.Object["metadata"] = mergeMetadata(obj.Object["metadata"], live.DeepCopy().Object["metadata"])
+			c.stamp(obj)
+			result, err = resource.Update(ctx, obj, metav1.UpdateOptions{FieldManager: c.fieldManager, DryRun: dryRun})
+		}
+		if err != nil {
+			return change, err
+		}
+	}
+
+	desired := stripServerFields(result).Object
+	if live == nil {
+		change.Action = ActionCreate
+		change.Fields = diffFields("", nil, desired, nil)
+		return change, nil
+	}
+	change.Fields = diffFields("", stripServerFields(live).Object, desired, nil)
+	change.Action = ActionUpdate
+	if len(change.Fields) == 0 {
+		change.Action = ActionNone
+	}
+	return change, nil
+}
+
+// diffFields lists the paths where live and desired differ, descending into
+// objects present on both sides. Lists are compared as a whole.
+func diffFields(path string, live, desired interface{}, changes []FieldChange) []FieldChange {
+	lm, liveIsMap := live.(map[string]interface{})
+	dm, desiredIsMap := desired.(map[string]interface{})
+	if liveIsMap && desiredIsMap {
+		keys := make([]string, 0, len(lm)+len(dm))
+		for k := range lm {
+			keys = append(keys, k)
+		}
+		for k := range dm {
+			if _, ok := lm[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			changes = diffFields(path+"."+k, lm[k], dm[k], changes)
+		}
+		return changes
+	}
+	if !reflect.DeepEqual(live, desired) {
+		changes = append(changes, FieldChange{Path: path, Live: live, Desired: desired})
+	}
+	return changes
+}
@@ -0,0 +1,46 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		live    interface{}
+		desired interface{}
+		want    []FieldChange
+	}{
+		{name: "equal", live: map[string]interface{}{"a": "x"}, desired: map[string]interface{}{"a": "x"}},
+		{name: "changed", live: map[string]interface{}{"a": "x"}, desired: map[string]interface{}{"a": "y"},
+			want: []FieldChange{{Path: ".a", Live: "x", Desired: "y"}}},
+		{name: "added and removed", live: map[string]interface{}{"a": "x"}, desired: map[string]interface{}{"b": "y"},
+			want: []FieldChange{{Path: ".a", Live: "x"}, {Path: ".b", Desired: "y"}}},
+		{name: "nested", live: map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(1)}},
+			desired: map[string]interface{}{"spec": map[string]interface{}{"replicas": int64(2)}},
+			want:    []FieldChange{{Path: ".spec.replicas", Live: int64(1), Desired: int64(2)}}},
+		{name: "list compared whole", live: map[string]interface{}{"args": []interface{}{"a"}},
+			desired: map[string]interface{}{"args": []interface{}{"a", "b"}},
+			want:    []FieldChange{{Path: ".args", Live: []interface{}{"a"}, Desired: []interface{}{"a", "b"}}}},
+		{name: "map replaced by a scalar", live: map[string]interface{}{"a": map[string]interface{}{"b": "c"}},
+			desired: map[string]interface{}{"a": "c"},
+			want:    []FieldChange{{Path: ".a", Live: map[string]interface{}{"b": "c"}, Desired: "c"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffFields("", tt.live, tt.desired, nil); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffFields() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"in-cluster/pkg/types"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+// newRESTMapper builds a mapper over a cached discovery client. The cache is
+// reset when a kind is not found, so CRDs installed after the agent started
+// are resolved as well.
+func newRESTMapper(cf *rest.Config) (meta.ResettableRESTMapper, error) {
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(cf)
+	if err != nil {
+		return nil, err
+	}
+	return restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient)), nil
+}
+
+// decodeManifest reads a JSON document that is a plain Kubernetes manifest
+// rather than an AppDKubernetes, nil is returned when it has no apiVersion and kind
+func decodeManifest(content []byte) *unstructured.Unstructured {
+	var object map[string]interface{}
+	if err := json.Unmarshal(content, &object); err != nil {
+		return nil
+	}
+	manifest := &unstructured.Unstructured{Object: object}
+	if manifest.GetAPIVersion() == "" || manifest.GetKind() == "" {
+		return nil
+	}
+	return manifest
+}
+
+// resolveManifest fills the resource info of a passthrough manifest from the
+// apiVersion and kind it carries
+func (c *client) resolveManifest(appDkube *types.AppDKubernetes) error {
+	manifest := appDkube.Manifest
+	gvk := manifest.GroupVersionKind()
+	if gvk.Kind == "" || gvk.Version == "" {
+		return fmt.Errorf("manifest requires apiVersion and kind")
+	}
+	mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		c.mapper.Reset()
+		mapping, err = c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("resolving %s: %w", gvk, err)
+	}
+
+	gvr := &appDkube.ResourceInfo.GroupVersionResource
+	if gvr.Resource != "" && (gvr.Group != mapping.Resource.Group || gvr.Version != mapping.Resource.Version ||
+		string(gvr.Resource) != mapping.Resource.Resource) {
+		return fmt.Errorf("groupVersionResource %s/%s/%s does not match manifest %s served as %s",
+			gvr.Group, gvr.Version, gvr.Resource, gvk, mapping.Resource)
+	}
+	gvr.Group = mapping.Resource.Group
+	gvr.Version = mapping.Resource.Version
+	gvr.Resource = types.Kind(mapping.Resource.Resource)
+	return nil
+}
+
+// clusterScoped asks discovery for the scope of the resource and falls back to
+// the known kinds when the API server cannot tell
+func (c *client) clusterScoped(gvr schema.GroupVersionResource) bool {
+	if c.mapper != nil {
+		var mapping *meta.RESTMapping
+		gvk, err := c.mapper.KindFor(gvr)
+		if err == nil {
+			mapping, err = c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		}
+		if err == nil {
+			return mapping.Scope.Name() == meta.RESTScopeNameRoot
+		}
+		c.logger.Debugf("Cannot resolve scope of %s, using known kinds: %v", gvr, err)
+	}
+	return types.Kind(gvr.Resource).ClusterScoped()
+}
@@ -0,0 +1,312 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"in-cluster/pkg/types"
+	errs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DriftPolicy decides what happens when an applied object no longer matches
+// the state the agent applied
+type DriftPolicy string
+
+const (
+	// DriftHeal applies the desired state again
+	DriftHeal DriftPolicy = "heal"
+	// DriftReport only reports the drift
+	DriftReport DriftPolicy = "report"
+	// DriftIgnore skips the object
+	DriftIgnore DriftPolicy = "ignore"
+)
+
+// DriftPolicyAnnotation overrides the default policy of a single resource
+const DriftPolicyAnnotation = "opamp.appdynamics.com/drift-policy"
+
+// ReconcileOptions configures the drift reconciler
+type ReconcileOptions struct {
+	// Interval between full scans of the applied objects
+	Interval time.Duration
+	// Policy used for resources without the policy annotation
+	Policy DriftPolicy
+}
+
+// Drift describes an applied object that no longer matches its desired state
+type Drift struct {
+	Ref    ObjectRef
+	Policy DriftPolicy
+	// Missing is set when the object was deleted
+	Missing bool
+	// Fields lists the paths of the drifted fields
+	Fields []string
+	// Healed is set when the desired state was applied again, Err when that failed
+	Healed bool
+	Err    error
+}
+
+func (d Drift) String() string {
+	if d.Missing {
+		return d.Ref.Key() + " was deleted"
+	}
+	return d.Ref.Key() + " drifted on " + strings.Join(d.Fields, ", ")
+}
+
+// Reconcile watches the applied objects and compares them with their desired
+// state on every change and every interval, until ctx is done. Only objects
+// applied since the agent started or restored from their config file have a
+// known desired state.
+func (c *client) Reconcile(ctx context.Context, opts ReconcileOptions, report func(Drift)) {
+	queue := workqueue.New()
+	go func() {
+		<-ctx.Done()
+		queue.ShutDown()
+	}()
+
+	// Informers are scoped to the namespaces of the applied objects, the agent
+	// may not list them cluster-wide. Cluster scoped kinds have no namespace.
+	managed := func(options *metav1.ListOptions) {
+		options.LabelSelector = ManagedByLabel + "=" + c.fieldManager
+	}
+	factories := make(map[string]dynamicinformer.DynamicSharedInformerFactory)
+	watched := make(map[ObjectRef]struct{})
+	scan := func() {
+		for _, ref := range c.applied.list() {
+			key := ObjectRef{GVR: ref.GVR, Namespace: ref.Namespace}
+			if _, ok := watched[key]; !ok {
+				watched[key] = struct{}{}
+				factory, ok := factories[ref.Namespace]
+				if !ok {
+					factory = dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.dynamicClient, 0, ref.Namespace, managed)
+					factories[ref.Namespace] = factory
+				}
+				factory.ForResource(ref.GVR).Informer().AddEventHandler(driftHandler(ref.GVR, queue))
+			}
+			queue.Add(ref)
+		}
+		for _, factory := range factories {
+			factory.Start(ctx.Done())
+		}
+	}
+
+	go func() {
+		for {
+			item, shutdown := queue.Get()
+			if shutdown {
+				return
+			}
+			if drift, ok := c.checkDrift(ctx, item.(ObjectRef), opts.Policy); ok {
+				report(drift)
+			}
+			queue.Done(item)
+		}
+	}()
+
+	scan()
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			scan()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func driftHandler(gvr schema.GroupVersionResource, queue workqueue.Interface) cache.ResourceEventHandler {
+	enqueue := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		if u, ok := obj.(*unstructured.Unstructured); ok {
+			queue.Add(ObjectRef{GVR: gvr, Namespace: u.GetNamespace(), Name: u.GetName()})
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, obj interface{}) { enqueue(obj) },
+		DeleteFunc: enqueue,
+	}
+}
+
+func (c *client) Restore(content []byte, contentType string) error {
+	members, err := c.decode(content, contentType)
+	if err != nil {
+		return err
+	}
+	for _, appDkube := range members {
+		if appDkube.ResourceInfo.OperationInfo.Operation == types.Delete {
+			continue
+		}
+		target, err := c.resolve(appDkube)
+		if err != nil {
+			return fmt.Errorf("%s: %w", memberName(appDkube), err)
+		}
+		// A generated name is only known to the object that was created
+		if target.Name == "" {
+			continue
+		}
+		obj, err := convertOtelCollectorToUnstructured(appDkube)
+		if err != nil {
+			return fmt.Errorf("%s: %w", memberName(appDkube), err)
+		}
+		obj.SetNamespace(target.Namespace)
+		c.stamp(obj)
+		c.track(target, obj)
+	}
+	return nil
+}
+
+// checkDrift compares the live object with its desired state and heals it
+// when the policy says so
+func (c *client) checkDrift(ctx context.Context, ref ObjectRef, defaultPolicy DriftPolicy) (Drift, bool) {
+	desired := c.applied.desiredOf(ref)
+	if desired == nil {
+		return Drift{}, false
+	}
+	policy := defaultPolicy
+	if value, ok := desired.GetAnnotations()[DriftPolicyAnnotation]; ok {
+		switch p := DriftPolicy(strings.ToLower(value)); p {
+		case DriftHeal, DriftReport, DriftIgnore:
+			policy = p
+		default:
+			c.logger.Errorf("Unknown %s %q on %s, using %s", DriftPolicyAnnotation, value, ref.Key(), policy)
+		}
+	}
+	if policy == DriftIgnore {
+		return Drift{}, false
+	}
+
+	live, err := c.resource(ref.GVR, ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	drift := Drift{Ref: ref, Policy: policy}
+	switch {
+	case errs.IsNotFound(err):
+		drift.Missing = true
+		live = nil
+	case err != nil:
+		c.logger.Errorf("Cannot read %s for drift detection: %v", ref.Key(), err)
+		return Drift{}, false
+	default:
+		drift.Fields = driftedFields("", desired.Object, live.Object, nil)
+		if len(drift.Fields) == 0 {
+			return Drift{}, false
+		}
+	}
+	if policy == DriftHeal {
+		drift.Err = c.heal(ctx, ref, desired, live)
+		drift.Healed = drift.Err == nil
+	}
+	return drift, true
+}
+
+// heal applies the desired state again, conflicts are forced on server-side
+// apply as the agent owns the object
+func (c *client) heal(ctx context.Context, ref ObjectRef, desired, live *unstructured.Unstructured) error {
+	obj := desired.DeepCopy()
+	resource := c.resource(ref.GVR, ref.Namespace)
+	if live == nil {
+		_, err := resource.Create(ctx, obj, metav1.CreateOptions{FieldManager: c.fieldManager})
+		return err
+	}
+	if c.applyMode == ApplyModeServerSide {
+		data, err := json.Marshal(obj.Object)
+		if err != nil {
+			return err
+		}
+		force := true
+		_, err = resource.Patch(ctx, ref.Name, k8stypes.ApplyPatchType, data,
+			metav1.PatchOptions{FieldManager: c.fieldManager, Force: &force})
+		return err
+	}
+	obj.SetResourceVersion(live.GetResourceVersion())
+	_, err := resource.Update(ctx, obj, metav1.UpdateOptions{FieldManager: c.fieldManager})
+	return err
+}
+
+// driftedFields returns the paths where live differs from desired. Fields the
+// desired state leaves out or empty are defaulted by the API server and do not
+// count as drift.
+func driftedFields(path string, desired, live interface{}, fields []string) []string {
+	switch d := desired.(type) {
+	case nil:
+		return fields
+	case map[string]interface{}:
+		if len(d) == 0 {
+			return fields
+		}
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return append(fields, path)
+		}
+		keys := make([]string, 0, len(d))
+		for k := range d {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fields = driftedFields(path+"."+k, d[k], l[k], fields)
+		}
+		return fields
+	case []interface{}:
+		if len(d) == 0 && live == nil {
+			return fields
+		}
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			return append(fields, path)
+		}
+		for i := range d {
+			fields = driftedFields(fmt.Sprintf("%s[%d]", path, i), d[i], l[i], fields)
+		}
+		return fields
+	default:
+		if !scalarEqual(desired, live) {
+			return append(fields, path)
+		}
+		return fields
+	}
+}
+
+// scalarEqual compares JSON scalars, numbers decode as float64 from the
+// payload and as int64 from the API server
+func scalarEqual(a, b interface{}) bool {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		return ok && fa == fb
+	}
+	return a == b
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
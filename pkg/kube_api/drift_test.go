@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"in-cluster/pkg/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDriftedFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		desired interface{}
+		live    interface{}
+		want    []string
+	}{
+		{name: "equal", desired: map[string]interface{}{"a": "x"}, live: map[string]interface{}{"a": "x"}},
+		{name: "defaulted field", desired: map[string]interface{}{"a": "x"},
+			live: map[string]interface{}{"a": "x", "b": "default"}},
+		{name: "empty desired map", desired: map[string]interface{}{"a": map[string]interface{}{}},
+			live: map[string]interface{}{"a": map[string]interface{}{"b": "c"}}},
+		{name: "empty desired list", desired: map[string]interface{}{"a": []interface{}{}},
+			live: map[string]interface{}{}},
+		{name: "changed value", desired: map[string]interface{}{"a": "x", "b": "y"},
+			live: map[string]interface{}{"a": "x", "b": "z"}, want: []string{".b"}},
+		{name: "removed field", desired: map[string]interface{}{"a": map[string]interface{}{"b": "c"}},
+			live: map[string]interface{}{}, want: []string{".a"}},
+		{name: "float against int", desired: map[string]interface{}{"replicas": float64(2)},
+			live: map[string]interface{}{"replicas": int64(2)}},
+		{name: "changed number", desired: map[string]interface{}{"replicas": float64(2)},
+			live: map[string]interface{}{"replicas": int64(3)}, want: []string{".replicas"}},
+		{name: "number against string", desired: map[string]interface{}{"port": float64(80)},
+			live: map[string]interface{}{"port": "80"}, want: []string{".port"}},
+		{name: "list length", desired: map[string]interface{}{"args": []interface{}{"a"}},
+			live: map[string]interface{}{"args": []interface{}{"a", "b"}}, want: []string{".args"}},
+		{name: "list item", desired: map[string]interface{}{"ports": []interface{}{map[string]interface{}{"port": float64(80)}}},
+			live: map[string]interface{}{"ports": []interface{}{map[string]interface{}{"port": int64(81), "protocol": "TCP"}}},
+			want: []string{".ports[0].port"}},
+		{name: "sorted paths", desired: map[string]interface{}{"b": "1", "a": "1"},
+			live: map[string]interface{}{"b": "2", "a": "2"}, want: []string{".a", ".b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := driftedFields("", tt.desired, tt.live, nil); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("driftedFields() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+const revisionAnnotation = "deployment.kubernetes.io/revision"
+
+func deploymentObject(replicas int64, annotations map[string]interface{}) *unstructured.Unstructured {
+	metadata := map[string]interface{}{"name": "web", "namespace": "default"}
+	if annotations != nil {
+		metadata["annotations"] = annotations
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata":   metadata,
+		"spec":       map[string]interface{}{"replicas": replicas},
+	}}
+}
+
+func TestUpdateTracksPayload(t *testing.T) {
+	gvr := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		deploymentObject(1, map[string]interface{}{revisionAnnotation: "1"}))
+	c := &client{logger: zap.NewNop().Sugar(), dynamicClient: dynamicClient, namespace: "default",
+		applyMode: ApplyModeUpdate, fieldManager: DefaultFieldManager}
+
+	appDkube := &types.AppDKubernetes{
+		ResourceInfo: types.ResourceInfo{
+			OperationInfo:        types.OperationInfo{Name: "web", Operation: types.Update},
+			GroupVersionResource: types.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+		},
+		Manifest: deploymentObject(2, nil),
+	}
+	ref, err := c.updateExisting(appDkube, "default")
+	if err != nil {
+		t.Fatalf("updateExisting() error = %v", err)
+	}
+	if _, ok := c.applied.desiredOf(ref).GetAnnotations()[revisionAnnotation]; ok {
+		t.Errorf("desired state of %s holds the live %s annotation", ref.Key(), revisionAnnotation)
+	}
+
+	// The deployment controller bumps the revision after every rollout
+	resource := dynamicClient.Resource(gvr).Namespace("default")
+	live, err := resource.Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got := live.GetAnnotations()[revisionAnnotation]; got != "1" {
+		t.Errorf("update dropped the live %s annotation, got %q", revisionAnnotation, got)
+	}
+	live.SetAnnotations(map[string]string{revisionAnnotation: "2"})
+	if _, err := resource.Update(context.Background(), live, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if drift, ok := c.checkDrift(context.Background(), ref, DriftReport); ok {
+		t.Errorf("checkDrift() = %v, want no drift", drift)
+	}
+
+	// A real change to the spec still counts
+	live, _ = resource.Get(context.Background(), "web", metav1.GetOptions{})
+	live.Object["spec"] = map[string]interface{}{"replicas": int64(3)}
+	if _, err := resource.Update(context.Background(), live, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	drift, ok := c.checkDrift(context.Background(), ref, DriftReport)
+	if want := []string{".spec.replicas"}; !ok || !reflect.DeepEqual(drift.Fields, want) {
+		t.Errorf("checkDrift() = %v, %v, want drift on %q", drift, ok, want)
+	}
+}
+
+func TestReconcileWatchesNamespaces(t *testing.T) {
+	deployments := schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	clusterRoles := schema.GroupVersionResource{Group: "rbac.authorization.k8s.io", Version: "v1", Resource: "clusterroles"}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			deployments:  "DeploymentList",
+			clusterRoles: "ClusterRoleList",
+		})
+	c := &client{logger: zap.NewNop().Sugar(), dynamicClient: dynamicClient, fieldManager: DefaultFieldManager}
+	c.Track([]ObjectRef{
+		{GVR: deployments, Namespace: "apps", Name: "web"},
+		{GVR: deployments, Namespace: "apps", Name: "api"},
+		{GVR: deployments, Namespace: "jobs", Name: "worker"},
+		{GVR: clusterRoles, Name: "reader"},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Reconcile(ctx, ReconcileOptions{Interval: time.Hour, Policy: DriftReport}, func(Drift) {})
+
+	listed := func() []string {
+		seen := make(map[string]struct{})
+		for _, action := range dynamicClient.Actions() {
+			if list, ok := action.(k8stesting.ListAction); ok {
+				seen[list.GetResource().Resource+"/"+list.GetNamespace()] = struct{}{}
+			}
+		}
+		var lists []string
+		for list := range seen {
+			lists = append(lists, list)
+		}
+		sort.Strings(lists)
+		return lists
+	}
+	want := []string{"clusterroles/", "deployments/apps", "deployments/jobs"}
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(listed(), want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := listed(); !reflect.DeepEqual(got, want) {
+		t.Errorf("informers listed %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"context"
+	errs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+	"sync"
+)
+
+// ObjectRef identifies an object applied by the agent
+type ObjectRef struct {
+	GVR       schema.GroupVersionResource `json:"gvr"`
+	Namespace string                      `json:"namespace,omitempty"`
+	Name      string                      `json:"name"`
+}
+
+// Key renders the ref as group/version/resource/namespace/name, the group is
+// omitted for the core API group and the namespace for cluster scoped objects
+func (r ObjectRef) Key() string {
+	key := r.GVR.Version + "/" + r.GVR.Resource
+	if r.GVR.Group != "" {
+		key = r.GVR.Group + "/" + key
+	}
+	if r.Namespace != "" {
+		key += "/" + r.Namespace
+	}
+	return key + "/" + r.Name
+}
+
+// serverManagedFields are populated by the API server and stripped before an
+// object is reported, so it can be compared with the desired manifest
+var serverManagedFields = [][]string{
+	{"metadata", "managedFields"},
+	{"metadata", "resourceVersion"},
+	{"metadata", "uid"},
+	{"metadata", "generation"},
+	{"metadata", "creationTimestamp"},
+	{"metadata", "selfLink"},
+	{"metadata", "annotations", "kubectl.kubernetes.io/last-applied-configuration"},
+	{"status"},
+}
+
+// appliedSet is the set of objects the agent applied and, for the ones
+// applied by this process, the desired state it wrote
+type appliedSet struct {
+	mu      sync.RWMutex
+	refs    map[string]ObjectRef
+	desired map[string]*unstructured.Unstructured
+}
+
+func (s *appliedSet) add(ref ObjectRef) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.refs == nil {
+		s.refs = make(map[string]ObjectRef)
+	}
+	s.refs[ref.Key()] = ref
+}
+
+// desire sets the desired state of the object, nil forgets it
+func (s *appliedSet) desire(ref ObjectRef, obj *unstructured.Unstructured) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if obj == nil {
+		delete(s.desired, ref.Key())
+		return
+	}
+	if s.desired == nil {
+		s.desired = make(map[string]*unstructured.Unstructured)
+	}
+	s.desired[ref.Key()] = obj
+}
+
+func (s *appliedSet) desiredOf(ref ObjectRef) *unstructured.Unstructured {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.desired[ref.Key()]
+}
+
+func (s *appliedSet) remove(ref ObjectRef) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.refs, ref.Key())
+	delete(s.desired, ref.Key())
+}
+
+func (s *appliedSet) list() []ObjectRef {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	refs := make([]ObjectRef, 0, len(s.refs))
+	for _, ref := range s.refs {
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+func (c *client) Track(refs []ObjectRef) {
+	for _, ref := range refs {
+		c.applied.add(ref)
+	}
+}
+
+// track records an object written by the agent together with its desired state
+func (c *client) track(ref ObjectRef, written *unstructured.Unstructured) {
+	desired := stripServerFields(written)
+	desired.SetName(ref.Name)
+	c.applied.add(ref)
+	c.applied.desire(ref, desired)
+}
+
+// EffectiveConfig reads every applied object back from the cluster and returns
+// them as YAML keyed by ObjectRef.Key. Objects deleted behind the agent's back
+// are dropped from the set, unless their desired state is known and the drift
+// reconciler can restore them. An object that cannot be read is reported with
+// its desired state, or left out when that is not known.
+func (c *client) EffectiveConfig(ctx context.Context) (map[string][]byte, error) {
+	config := make(map[string][]byte)
+	for _, ref := range c.applied.list() {
+		obj, err := c.resource(ref.GVR, ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if errs.IsNotFound(err) {
+			c.logger.Debugf("Applied object %s no longer exists", ref.Key())
+			if c.applied.desiredOf(ref) == nil {
+				c.applied.remove(ref)
+			}
+			continue
+		}
+		if err != nil {
+			// One unreadable object must not hide the others, the desired
+			// state stands in for it when it is known.
+			obj = c.applied.desiredOf(ref)
+			if obj == nil {
+				c.logger.Errorf("Cannot read applied object %s, leaving it out of the effective config: %v", ref.Key(), err)
+				continue
+			}
+			c.logger.Errorf("Cannot read applied object %s, reporting its desired state: %v", ref.Key(), err)
+		}
+		body, err := yaml.Marshal(stripServerFields(obj).Object)
+		if err != nil {
+			return nil, err
+		}
+		config[ref.Key()] = body
+	}
+	return config, nil
+}
+
+func stripServerFields(obj *unstructured.Unstructured) *unstructured.Unstructured {
+	stripped := obj.DeepCopy()
+	for _, field := range serverManagedFields {
+		unstructured.RemoveNestedField(stripped.Object, field...)
+	}
+	if len(stripped.GetAnnotations()) == 0 {
+		unstructured.RemoveNestedField(stripped.Object, "metadata", "annotations")
+	}
+	return stripped
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"context"
+	"go.uber.org/zap"
+	errs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var configMapsGVR = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+func configMapObject(name string, data map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "default"},
+		"data":       data,
+	}}
+}
+
+func TestEffectiveConfigSkipsUnreadableObjects(t *testing.T) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		configMapObject("live", map[string]interface{}{"a": "live"}))
+	dynamicClient.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		name := action.(k8stesting.GetAction).GetName()
+		if name == "forbidden" || name == "forbidden-desired" {
+			return true, nil, errs.NewForbidden(configMapsGVR.GroupResource(), name, nil)
+		}
+		return false, nil, nil
+	})
+	c := &client{logger: zap.NewNop().Sugar(), dynamicClient: dynamicClient}
+
+	ref := func(name string) ObjectRef {
+		return ObjectRef{GVR: configMapsGVR, Namespace: "default", Name: name}
+	}
+	c.Track([]ObjectRef{ref("live"), ref("forbidden"), ref("gone")})
+	c.track(ref("forbidden-desired"), configMapObject("forbidden-desired", map[string]interface{}{"a": "desired"}))
+
+	config, err := c.EffectiveConfig(context.Background())
+	if err != nil {
+		t.Fatalf("EffectiveConfig() error = %v", err)
+	}
+	var keys []string
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	want := []string{"v1/configmaps/default/forbidden-desired", "v1/configmaps/default/live"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Fatalf("EffectiveConfig() keys = %q, want %q", keys, want)
+	}
+	if got := string(config[want[0]]); !strings.Contains(got, "a: desired") {
+		t.Errorf("EffectiveConfig() reports %q, want the desired state", got)
+	}
+
+	// The deleted object is dropped, the unreadable one is kept
+	var tracked []string
+	for _, r := range c.applied.list() {
+		tracked = append(tracked, r.Name)
+	}
+	sort.Strings(tracked)
+	if want := []string{"forbidden", "forbidden-desired", "live"}; !reflect.DeepEqual(tracked, want) {
+		t.Errorf("tracked objects = %q, want %q", tracked, want)
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"strings"
+)
+
+// EnvelopeVersion is the version of the payload envelope this client reads
+const EnvelopeVersion = "v1"
+
+// Encoding of the payload carried in an envelope
+type Encoding string
+
+const (
+	// EncodingJSON embeds the resources as a JSON (or YAML) value
+	EncodingJSON Encoding = "json"
+	// EncodingYAML carries YAML documents in a string
+	EncodingYAML Encoding = "yaml"
+	// EncodingBase64 carries base64 encoded JSON or YAML in a string, which
+	// may be gzip compressed
+	EncodingBase64 Encoding = "base64"
+	// EncodingJSONString carries JSON encoded once more as a string
+	EncodingJSONString Encoding = "json-string"
+)
+
+// ErrInvalidEnvelope is returned for an envelope that cannot be decoded
+var ErrInvalidEnvelope = errors.New("invalid payload envelope")
+
+// envelope wraps the resources of a config file, see the README for the format
+type envelope struct {
+	EnvelopeVersion string          `json:"envelopeVersion"`
+	Encoding        Encoding        `json:"encoding"`
+	ContentType     string          `json:"contentType,omitempty"`
+	Payload         json.RawMessage `json:"payload"`
+}
+
+// openEnvelope returns the payload of an enveloped config file and its content
+// type. Content without an envelopeVersion field is returned as is.
+func openEnvelope(content []byte, contentType string) ([]byte, string, bool, error) {
+	data := content
+	if contentType == contentTypeYAML {
+		converted, err := yaml.ToJSON(content)
+		if err != nil {
+			return content, contentType, false, nil
+		}
+		data = converted
+	}
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return content, contentType, false, nil
+	}
+	if _, ok := probe["envelopeVersion"]; !ok {
+		return content, contentType, false, nil
+	}
+
+	var env envelope
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&env); err != nil {
+		return nil, "", true, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	payload, payloadType, err := env.open()
+	if err != nil {
+		return nil, "", true, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	return payload, payloadType, true, nil
+}
+
+func (e *envelope) open() ([]byte, string, error) {
+	if e.EnvelopeVersion != EnvelopeVersion {
+		return nil, "", fmt.Errorf("unsupported envelopeVersion %q, expected %q", e.EnvelopeVersion, EnvelopeVersion)
+	}
+	if len(e.Payload) == 0 || bytes.Equal(e.Payload, []byte("null")) {
+		return nil, "", errors.New("payload is required")
+	}
+	if e.ContentType != "" && e.Encoding != EncodingBase64 {
+		return nil, "", fmt.Errorf("contentType is only allowed with the %s encoding", EncodingBase64)
+	}
+
+	switch e.Encoding {
+	case EncodingJSON:
+		return e.Payload, contentTypeJSON, nil
+	case EncodingYAML:
+		s, err := e.stringPayload()
+		if err != nil {
+			return nil, "", err
+		}
+		return []byte(s), contentTypeYAML, nil
+	case EncodingJSONString:
+		s, err := e.stringPayload()
+		if err != nil {
+			return nil, "", err
+		}
+		if !json.Valid([]byte(s)) {
+			return nil, "", fmt.Errorf("payload of the %s encoding is not valid JSON", EncodingJSONString)
+		}
+		return []byte(s), contentTypeJSON, nil
+	case EncodingBase64:
+		s, err := e.stringPayload()
+		if err != nil {
+			return nil, "", err
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+		if err != nil {
+			return nil, "", fmt.Errorf("payload is not valid base64: %v", err)
+		}
+		if bytes.HasPrefix(decoded, gzipMagic) {
+			if decoded, err = gunzip(decoded); err != nil {
+				return nil, "", err
+			}
+		}
+		switch e.ContentType {
+		case "", contentTypeYAML:
+			return decoded, contentTypeYAML, nil
+		case contentTypeJSON:
+			return decoded, contentTypeJSON, nil
+		default:
+			return nil, "", fmt.Errorf("contentType %q is not supported, use application/json or application/yaml", e.ContentType)
+		}
+	case "":
+		return nil, "", errors.New("encoding is required")
+	default:
+		return nil, "", fmt.Errorf("encoding %q is not supported, use %s, %s, %s or %s", e.Encoding,
+			EncodingJSON, EncodingYAML, EncodingBase64, EncodingJSONString)
+	}
+}
+
+func (e *envelope) stringPayload() (string, error) {
+	var s string
+	if err := json.Unmarshal(e.Payload, &s); err != nil {
+		return "", fmt.Errorf("the %s encoding requires a string payload", e.Encoding)
+	}
+	return s, nil
+}
+
+// legacyUnescape undoes the escaping of the payloads sent before the envelope
+// existed. It also rewrites legitimate values containing \" or braces, which
+// is why it only runs when Options.LegacyPayloads is set.
+func legacyUnescape(content []byte) []byte {
+	if strings.Contains(string(content), "opentelemetrycollectors") {
+		return content
+	}
+	content = []byte(strings.ReplaceAll(string(content), `\"`, `"`))
+	content = []byte(strings.ReplaceAll(string(content), `\n`, ``))
+	content = []byte(strings.ReplaceAll(string(content), `"{`, `{`))
+	content = []byte(strings.ReplaceAll(string(content), `}"`, `}`))
+	return content
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func TestOpenEnvelope(t *testing.T) {
+	const member = `{"kind":"ConfigMap"}`
+	b64 := base64.StdEncoding.EncodeToString
+	tests := []struct {
+		name        string
+		content     string
+		contentType string
+		want        string
+		wantType    string
+		enveloped   bool
+		wantErr     bool
+	}{
+		{name: "no envelope", content: member, contentType: contentTypeJSON, want: member, wantType: contentTypeJSON},
+		{name: "yaml without envelope", content: "kind: ConfigMap\n", contentType: contentTypeYAML,
+			want: "kind: ConfigMap\n", wantType: contentTypeYAML},
+		{name: "list is not an envelope", content: "[" + member + "]", contentType: contentTypeJSON,
+			want: "[" + member + "]", wantType: contentTypeJSON},
+		{name: "json", content: `{"envelopeVersion":"v1","encoding":"json","payload":` + member + `}`,
+			contentType: contentTypeJSON, want: member, wantType: contentTypeJSON, enveloped: true},
+		{name: "json in a yaml envelope", content: "envelopeVersion: v1\nencoding: json\npayload:\n  kind: ConfigMap\n",
+			contentType: contentTypeYAML, want: member, wantType: contentTypeJSON, enveloped: true},
+		{name: "yaml", content: `{"envelopeVersion":"v1","encoding":"yaml","payload":"kind: ConfigMap\n"}`,
+			contentType: contentTypeJSON, want: "kind: ConfigMap\n", wantType: contentTypeYAML, enveloped: true},
+		{name: "json string", content: `{"envelopeVersion":"v1","encoding":"json-string","payload":"{\"kind\":\"ConfigMap\"}"}`,
+			contentType: contentTypeJSON, want: member, wantType: contentTypeJSON, enveloped: true},
+		{name: "base64 yaml", content: `{"envelopeVersion":"v1","encoding":"base64","payload":"` + b64([]byte("kind: ConfigMap\n")) + `"}`,
+			contentType: contentTypeJSON, want: "kind: ConfigMap\n", wantType: contentTypeYAML, enveloped: true},
+		{name: "base64 gzip json", content: `{"envelopeVersion":"v1","encoding":"base64","contentType":"application/json",` +
+			`"payload":"` + b64(gzipped(t, member)) + `"}`,
+			contentType: contentTypeJSON, want: member, wantType: contentTypeJSON, enveloped: true},
+		{name: "unknown field", content: `{"envelopeVersion":"v1","encoding":"json","payload":{},"extra":1}`,
+			contentType: contentTypeJSON, enveloped: true, wantErr: true},
+		{name: "unsupported version", content: `{"envelopeVersion":"v2","encoding":"json","payload":{}}`,
+			contentType: contentTypeJSON, enveloped: true, wantErr: true},
+		{name: "missing payload", content: `{"envelopeVersion":"v1","encoding":"json"}`,
+			contentType: contentTypeJSON, enveloped: true, wantErr: true},
+		{name: "missing encoding", content: `{"envelopeVersion":"v1","payload":{}}`,
+			contentType: contentTypeJSON, enveloped: true, wantErr: true},
+		{name: "content type without base64", content: `{"envelopeVersion":"v1","encoding":"yaml","contentType":"application/yaml","payload":"a: b"}`,
+			contentType: contentTypeJSON, enveloped: true, wantErr: true},
+		{name: "yaml requires a string", content: `{"envelopeVersion":"v1","encoding":"yaml","payload":{}}`,
+			contentType: contentTypeJSON, enveloped: true, wantErr: true},
+		{name: "invalid json string", content: `{"envelopeVersion":"v1","encoding":"json-string","payload":"{"}`,
+			contentType: contentTypeJSON, enveloped: true, wantErr: true},
+		{name: "invalid base64", content: `{"envelopeVersion":"v1","encoding":"base64","payload":"%%%"}`,
+			contentType: contentTypeJSON, enveloped: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotType, enveloped, err := openEnvelope([]byte(tt.content), tt.contentType)
+			if enveloped != tt.enveloped {
+				t.Errorf("openEnvelope() enveloped = %v, want %v", enveloped, tt.enveloped)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidEnvelope) {
+					t.Fatalf("openEnvelope() error = %v, want %v", err, ErrInvalidEnvelope)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("openEnvelope() error = %v", err)
+			}
+			if string(got) != tt.want || gotType != tt.wantType {
+				t.Errorf("openEnvelope() = %q, %q, want %q, %q", got, gotType, tt.want, tt.wantType)
+			}
+		})
+	}
+}
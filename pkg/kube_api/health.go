@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"context"
+	errs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// HealthState summarizes the status of a managed object
+type HealthState string
+
+const (
+	// HealthHealthy objects are ready or have no status to tell otherwise
+	HealthHealthy HealthState = "healthy"
+	// HealthProgressing objects are still rolling out
+	HealthProgressing HealthState = "progressing"
+	// HealthDegraded objects failed and need a new config
+	HealthDegraded HealthState = "degraded"
+	// HealthMissing objects were deleted behind the agent's back
+	HealthMissing HealthState = "missing"
+)
+
+// Condition is a status condition of a managed object
+type Condition struct {
+	Type    string `json:"type"`
+	Status  string `json:"status"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// ObjectHealth is the health of a managed object and the status it derives from
+type ObjectHealth struct {
+	Object     ObjectRef   `json:"object"`
+	State      HealthState `json:"state"`
+	Message    string      `json:"message,omitempty"`
+	Phase      string      `json:"phase,omitempty"`
+	Conditions []Condition `json:"conditions,omitempty"`
+}
+
+// healthSyncTimeout bounds the wait for a new informer to list its objects,
+// until it has they are read from the API server
+const healthSyncTimeout = 30 * time.Second
+
+// healthInformer is keyed by the resource and the namespace it watches, empty
+// for cluster scoped resources
+type healthInformer struct {
+	gvr       schema.GroupVersionResource
+	namespace string
+}
+
+// Healthy reports whether the object is neither degraded nor missing
+func (h ObjectHealth) Healthy() bool {
+	return h.State == HealthHealthy || h.State == HealthProgressing
+}
+
+// WatchHealth watches the status of the applied objects and reports the health
+// of all of them whenever it changes, until ctx is done. Objects applied since
+// the last report are picked up every interval. Only the namespaces objects
+// were applied to are watched, the agent may not be allowed to list others.
+func (c *client) WatchHealth(ctx context.Context, interval time.Duration, report func([]ObjectHealth)) {
+	changed := make(chan struct{}, 1)
+	notify := func(interface{}) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, obj interface{}) { notify(obj) },
+		DeleteFunc: notify,
+	}
+
+	managed := func(options *metav1.ListOptions) {
+		options.LabelSelector = ManagedByLabel + "=" + c.fieldManager
+	}
+	factories := make(map[string]dynamicinformer.DynamicSharedInformerFactory)
+	informers := make(map[healthInformer]cache.SharedIndexInformer)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last []ObjectHealth
+	for {
+		refs := c.applied.list()
+		sort.Slice(refs, func(i, j int) bool { return refs[i].Key() < refs[j].Key() })
+		added := make(map[healthInformer]cache.SharedIndexInformer)
+		for _, ref := range refs {
+			key := healthInformer{gvr: ref.GVR, namespace: ref.Namespace}
+			if _, ok := informers[key]; ok {
+				continue
+			}
+			factory, ok := factories[ref.Namespace]
+			if !ok {
+				factory = dynamicinformer.NewFilteredDynamicSharedInformerFactory(c.dynamicClient, 0, ref.Namespace, managed)
+				factories[ref.Namespace] = factory
+			}
+			informers[key] = factory.ForResource(ref.GVR).Informer()
+			informers[key].AddEventHandler(handler)
+			added[key] = informers[key]
+		}
+		for _, factory := range factories {
+			factory.Start(ctx.Done())
+		}
+		c.waitForHealthSync(ctx, added)
+
+		health := make([]ObjectHealth, 0, len(refs))
+		for _, ref := range refs {
+			informer := informers[healthInformer{gvr: ref.GVR, namespace: ref.Namespace}]
+			health = append(health, objectHealth(ref, c.cached(ctx, informer, ref)))
+		}
+		if ctx.Err() == nil && !reflect.DeepEqual(health, last) {
+			report(health)
+			last = health
+		}
+
+		select {
+		case <-changed:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// waitForHealthSync waits up to healthSyncTimeout for the new informers. One
+// that did not sync, for example without the RBAC to list its resource, keeps
+// retrying in the background while its objects are read from the API server.
+func (c *client) waitForHealthSync(ctx context.Context, informers map[healthInformer]cache.SharedIndexInformer) {
+	if len(informers) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthSyncTimeout)
+	defer cancel()
+	for key, informer := range informers {
+		if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+			c.logger.Warnf("Cannot watch %s in namespace %q within %s, reading them from the API server",
+				key.gvr.Resource, key.namespace, healthSyncTimeout)
+		}
+	}
+}
+
+// cached returns the object from the informer, objects it does not hold, those
+// without the managed-by label or not listed yet, are read from the API server.
+// nil is returned when the object does not exist.
+func (c *client) cached(ctx context.Context, informer cache.SharedIndexInformer, ref ObjectRef) *unstructured.Unstructured {
+	key := ref.Name
+	if ref.Namespace != "" {
+		key = ref.Namespace + "/" + ref.Name
+	}
+	if item, ok, err := informer.GetStore().GetByKey(key); err == nil && ok {
+		if obj, ok := item.(*unstructured.Unstructured); ok {
+			return obj
+		}
+	}
+	obj, err := c.resource(ref.GVR, ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		if !errs.IsNotFound(err) {
+			c.logger.Debugf("Cannot read %s for its health: %v", ref.Key(), err)
+		}
+		return nil
+	}
+	return obj
+}
+
+// objectHealth derives the health from the readiness check of the kind, or
+// from the common Ready, Available, Failed and Degraded conditions
+func objectHealth(ref ObjectRef, obj *unstructured.Unstructured) ObjectHealth {
+	health := ObjectHealth{Object: ref, State: HealthHealthy}
+	if obj == nil {
+		health.State, health.Message = HealthMissing, "not found"
+		return health
+	}
+	health.Phase, _, _ = unstructured.NestedString(obj.Object, "status", "phase")
+	health.Conditions = conditions(obj)
+
+	if check, ok := readinessChecks[ref.GVR.Resource]; ok {
+		ready, reason, err := check(obj)
+		switch {
+		case err != nil:
+			health.State, health.Message = HealthDegraded, err.Error()
+		case !ready:
+			health.State, health.Message = HealthProgressing, reason
+		}
+		return health
+	}
+	for _, cond := range health.Conditions {
+		message := cond.Message
+		if message == "" {
+			message = cond.Reason
+		}
+		switch {
+		case (cond.Type == "Failed" || cond.Type == "Degraded") && cond.Status == string(metav1.ConditionTrue):
+			health.State, health.Message = HealthDegraded, cond.Type+": "+message
+			return health
+		case (cond.Type == "Ready" || cond.Type == "Available") && cond.Status == string(metav1.ConditionFalse):
+			health.State, health.Message = HealthProgressing, cond.Type+" is False: "+message
+		}
+	}
+	return health
+}
+
+func conditions(obj *unstructured.Unstructured) []Condition {
+	items, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	var result []Condition
+	for _, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		cond := Condition{}
+		cond.Type, _ = m["type"].(string)
+		cond.Status, _ = m["status"].(string)
+		cond.Reason, _ = m["reason"].(string)
+		cond.Message, _ = m["message"].(string)
+		result = append(result, cond)
+	}
+	return result
+}
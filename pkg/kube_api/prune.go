@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"context"
+	"fmt"
+	errs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"strings"
+)
+
+const (
+	// ManagedByLabel is stamped on every object the agent writes, its value is
+	// the field manager of the agent
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	// ProtectAnnotation set to "true" keeps an object from being pruned
+	ProtectAnnotation = "opamp.appdynamics.com/protect"
+)
+
+// stamp marks the object as owned by the agent
+func (c *client) stamp(obj *unstructured.Unstructured) {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	labels[ManagedByLabel] = c.fieldManager
+	obj.SetLabels(labels)
+}
+
+// Prune deletes the objects owned by the agent and returns the ones that are
+// gone, including those that no longer existed. Objects without the ownership
+// label or with the protect annotation are left alone. With dryRun nothing is
+// deleted, the objects that would be are returned.
+func (c *client) Prune(ctx context.Context, refs []ObjectRef, dryRun bool) ([]ObjectRef, error) {
+	var (
+		pruned []ObjectRef
+		failed []string
+	)
+	for _, ref := range refs {
+		resource := c.resource(ref.GVR, ref.Namespace)
+		obj, err := resource.Get(ctx, ref.Name, metav1.GetOptions{})
+		if errs.IsNotFound(err) {
+			// Already gone, which is what pruning it would achieve
+			c.applied.remove(ref)
+			if !dryRun {
+				pruned = append(pruned, ref)
+			}
+			continue
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", ref.Key(), err))
+			continue
+		}
+		if obj.GetLabels()[ManagedByLabel] != c.fieldManager {
+			c.logger.Infof("Not pruning %s, it is not managed by %s", ref.Key(), c.fieldManager)
+			continue
+		}
+		if strings.EqualFold(obj.GetAnnotations()[ProtectAnnotation], "true") {
+			c.logger.Infof("Not pruning %s, it is protected by %s", ref.Key(), ProtectAnnotation)
+			continue
+		}
+		if dryRun {
+			c.logger.Infof("Would prune %s", ref.Key())
+			pruned = append(pruned, ref)
+			continue
+		}
+
+		// The uid precondition keeps a recreated object with the same name safe.
+		uid := obj.GetUID()
+		err = resource.Delete(ctx, ref.Name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &uid}})
+		if err != nil && !errs.IsNotFound(err) {
+			failed = append(failed, fmt.Sprintf("%s: %v", ref.Key(), err))
+			continue
+		}
+		c.logger.Infof("Pruned %s", ref.Key())
+		c.applied.remove(ref)
+		pruned = append(pruned, ref)
+	}
+	if len(failed) > 0 {
+		return pruned, fmt.Errorf("failed to prune %d objects: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return pruned, nil
+}
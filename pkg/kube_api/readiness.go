@@ -0,0 +1,282 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	errs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReadinessTimeoutAnnotation overrides the readiness timeout of a single
+// resource, "0" skips waiting for it
+const ReadinessTimeoutAnnotation = "opamp.appdynamics.com/readiness-timeout"
+
+// ErrNotReady is returned when objects fail or do not become ready in time
+var ErrNotReady = errors.New("not ready")
+
+const defaultReadinessInterval = 2 * time.Second
+
+// ReadinessOptions configures how long and how often readiness is polled
+type ReadinessOptions struct {
+	Timeout  time.Duration
+	Interval time.Duration
+}
+
+// readinessCheck reports whether the object is ready and why not. An error is
+// returned when the object cannot become ready without a new config.
+type readinessCheck func(obj *unstructured.Unstructured) (bool, string, error)
+
+var readinessChecks = map[string]readinessCheck{
+	"deployments":             deploymentReady,
+	"statefulsets":            statefulSetReady,
+	"daemonsets":              daemonSetReady,
+	"pods":                    podReady,
+	"opentelemetrycollectors": collectorReady,
+}
+
+// WaitReady polls the objects until every one is ready or its timeout passed.
+// Kinds without a readiness check are ready as soon as they exist.
+func (c *client) WaitReady(ctx context.Context, refs []ObjectRef, opts ReadinessOptions) error {
+	start := time.Now()
+	pending := make(map[string]ObjectRef, len(refs))
+	for _, ref := range refs {
+		if _, ok := readinessChecks[ref.GVR.Resource]; ok {
+			pending[ref.Key()] = ref
+		}
+	}
+	failed := make(map[string]string)
+	reasons := make(map[string]string)
+
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = defaultReadinessInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for len(pending) > 0 {
+		for key, ref := range pending {
+			obj, err := c.resource(ref.GVR, ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+			var (
+				ready  bool
+				reason string
+			)
+			switch {
+			case errs.IsNotFound(err):
+				reason = "not found"
+			case err != nil:
+				reason = err.Error()
+			default:
+				ready, reason, err = readinessChecks[ref.GVR.Resource](obj)
+				if err != nil {
+					failed[key] = err.Error()
+					delete(pending, key)
+					continue
+				}
+			}
+			if ready || timeoutOf(obj, opts.Timeout) == 0 {
+				c.logger.Debugf("%s is ready", key)
+				delete(pending, key)
+				continue
+			}
+			if time.Since(start) >= timeoutOf(obj, opts.Timeout) {
+				failed[key] = "timed out, " + reason
+				delete(pending, key)
+				continue
+			}
+			reasons[key] = reason
+		}
+		if len(pending) == 0 {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			for key := range pending {
+				failed[key] = reasons[key]
+			}
+			pending = nil
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+	messages := make([]string, 0, len(failed))
+	for key, reason := range failed {
+		messages = append(messages, key+": "+reason)
+	}
+	sort.Strings(messages)
+	return fmt.Errorf("%w: %s", ErrNotReady, strings.Join(messages, "; "))
+}
+
+func timeoutOf(obj *unstructured.Unstructured, timeout time.Duration) time.Duration {
+	if obj == nil {
+		return timeout
+	}
+	value, ok := obj.GetAnnotations()[ReadinessTimeoutAnnotation]
+	if !ok {
+		return timeout
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return d
+	}
+	return timeout
+}
+
+// observed reports whether the controller has seen the latest spec
+func observed(obj *unstructured.Unstructured) bool {
+	generation, found, _ := unstructured.NestedInt64(obj.Object, "status", "observedGeneration")
+	return found && generation >= obj.GetGeneration()
+}
+
+func nestedInt(obj *unstructured.Unstructured, fields ...string) int64 {
+	value, _, _ := unstructured.NestedInt64(obj.Object, fields...)
+	return value
+}
+
+// specReplicas is spec.replicas, which defaults to 1
+func specReplicas(obj *unstructured.Unstructured) int64 {
+	replicas, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	if !found {
+		return 1
+	}
+	return replicas
+}
+
+func condition(obj *unstructured.Unstructured, conditionType string) map[string]interface{} {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		if m, ok := c.(map[string]interface{}); ok && m["type"] == conditionType {
+			return m
+		}
+	}
+	return nil
+}
+
+func deploymentReady(obj *unstructured.Unstructured) (bool, string, error) {
+	if !observed(obj) {
+		return false, "rollout not observed yet", nil
+	}
+	if c := condition(obj, "Progressing"); c != nil && c["reason"] == "ProgressDeadlineExceeded" {
+		return false, "", fmt.Errorf("rollout exceeded its progress deadline: %v", c["message"])
+	}
+	replicas := specReplicas(obj)
+	updated := nestedInt(obj, "status", "updatedReplicas")
+	total := nestedInt(obj, "status", "replicas")
+	available := nestedInt(obj, "status", "availableReplicas")
+	switch {
+	case updated < replicas:
+		return false, fmt.Sprintf("%d of %d replicas updated", updated, replicas), nil
+	case total > updated:
+		return false, fmt.Sprintf("%d old replicas pending termination", total-updated), nil
+	case available < updated:
+		return false, fmt.Sprintf("%d of %d updated replicas available", available, updated), nil
+	}
+	return true, "", nil
+}
+
+func statefulSetReady(obj *unstructured.Unstructured) (bool, string, error) {
+	if !observed(obj) {
+		return false, "rollout not observed yet", nil
+	}
+	replicas := specReplicas(obj)
+	ready := nestedInt(obj, "status", "readyReplicas")
+	strategy, _, _ := unstructured.NestedString(obj.Object, "spec", "updateStrategy", "type")
+	if strategy != "OnDelete" {
+		partition := nestedInt(obj, "spec", "updateStrategy", "rollingUpdate", "partition")
+		updated := nestedInt(obj, "status", "updatedReplicas")
+		if updated < replicas-partition {
+			return false, fmt.Sprintf("%d of %d replicas updated", updated, replicas-partition), nil
+		}
+		current, _, _ := unstructured.NestedString(obj.Object, "status", "currentRevision")
+		update, _, _ := unstructured.NestedString(obj.Object, "status", "updateRevision")
+		if partition == 0 && current != update {
+			return false, fmt.Sprintf("revision %s not rolled out", update), nil
+		}
+	}
+	if ready < replicas {
+		return false, fmt.Sprintf("%d of %d replicas ready", ready, replicas), nil
+	}
+	return true, "", nil
+}
+
+func daemonSetReady(obj *unstructured.Unstructured) (bool, string, error) {
+	if !observed(obj) {
+		return false, "rollout not observed yet", nil
+	}
+	desired := nestedInt(obj, "status", "desiredNumberScheduled")
+	updated := nestedInt(obj, "status", "updatedNumberScheduled")
+	available := nestedInt(obj, "status", "numberAvailable")
+	switch {
+	case updated < desired:
+		return false, fmt.Sprintf("%d of %d pods updated", updated, desired), nil
+	case available < desired:
+		return false, fmt.Sprintf("%d of %d pods available", available, desired), nil
+	}
+	return true, "", nil
+}
+
+func podReady(obj *unstructured.Unstructured) (bool, string, error) {
+	phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+	switch phase {
+	case "Succeeded":
+		return true, "", nil
+	case "Failed":
+		reason, _, _ := unstructured.NestedString(obj.Object, "status", "reason")
+		return false, "", fmt.Errorf("pod failed: %s", reason)
+	}
+	if c := condition(obj, "Ready"); c != nil && c["status"] == "True" {
+		return true, "", nil
+	}
+	statuses, _, _ := unstructured.NestedSlice(obj.Object, "status", "containerStatuses")
+	for _, s := range statuses {
+		status, _ := s.(map[string]interface{})
+		reason, _, _ := unstructured.NestedString(status, "state", "waiting", "reason")
+		if reason != "" {
+			return false, fmt.Sprintf("container %v is %s", status["name"], reason), nil
+		}
+	}
+	return false, fmt.Sprintf("pod is %s and not ready", phase), nil
+}
+
+// collectorReady waits for the operator to report the collector version and,
+// for deployment and statefulset modes, the requested replicas
+func collectorReady(obj *unstructured.Unstructured) (bool, string, error) {
+	version, _, _ := unstructured.NestedString(obj.Object, "status", "version")
+	if version == "" {
+		return false, "operator has not reconciled the collector yet", nil
+	}
+	mode, _, _ := unstructured.NestedString(obj.Object, "spec", "mode")
+	if mode == "sidecar" || mode == "daemonset" {
+		return true, "", nil
+	}
+	replicas := specReplicas(obj)
+	// Newer operators report ready/total pods in statusReplicas.
+	if statusReplicas, found, _ := unstructured.NestedString(obj.Object, "status", "scale", "statusReplicas"); found {
+		if parts := strings.SplitN(statusReplicas, "/", 2); len(parts) == 2 {
+			ready, _ := strconv.ParseInt(parts[0], 10, 64)
+			if ready < replicas {
+				return false, fmt.Sprintf("%d of %d replicas ready", ready, replicas), nil
+			}
+		}
+	}
+	if scaled := nestedInt(obj, "status", "scale", "replicas"); scaled < replicas {
+		return false, fmt.Sprintf("%d of %d replicas", scaled, replicas), nil
+	}
+	return true, "", nil
+}
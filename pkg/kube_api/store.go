@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package kube_api
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	errs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// Store persists small key/value data of the agent in the cluster
+type Store interface {
+	// Load returns the stored data, an empty map when nothing was stored yet
+	Load(ctx context.Context) (map[string]string, error)
+	// Save merges data into the stored keys
+	Save(ctx context.Context, data map[string]string) error
+}
+
+type StoreKind string
+
+const (
+	ConfigMapStore StoreKind = "configmaps"
+	SecretStore    StoreKind = "secrets"
+)
+
+type store struct {
+	dynamicClient dynamic.Interface
+	kind          StoreKind
+	namespace     string
+	name          string
+}
+
+func (c *client) Store(kind StoreKind, namespace, name string) Store {
+	return &store{
+		dynamicClient: c.dynamicClient,
+		kind:          kind,
+		namespace:     namespace,
+		name:          name,
+	}
+}
+
+// ClusterUID returns the uid of the kube-system namespace, the conventional
+// identifier of a cluster
+func (c *client) ClusterUID(ctx context.Context) (string, error) {
+	ns, err := c.dynamicClient.Resource(schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}).
+		Get(ctx, "kube-system", metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	return string(ns.GetUID()), nil
+}
+
+func (s *store) resource() dynamic.ResourceInterface {
+	return s.dynamicClient.Resource(schema.GroupVersionResource{Version: "v1", Resource: string(s.kind)}).
+		Namespace(s.namespace)
+}
+
+func (s *store) Load(ctx context.Context) (map[string]string, error) {
+	obj, err := s.resource().Get(ctx, s.name, metav1.GetOptions{})
+	if errs.IsNotFound(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.decode(obj)
+}
+
+func (s *store) Save(ctx context.Context, data map[string]string) error {
+	obj, err := s.resource().Get(ctx, s.name, metav1.GetOptions{})
+	switch {
+	case errs.IsNotFound(err):
+		obj = &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       s.objectKind(),
+			"metadata": map[string]interface{}{
+				"name":      s.name,
+				"namespace": s.namespace,
+			},
+		}}
+		if err = s.encode(obj, data); err != nil {
+			return err
+		}
+		_, err = s.resource().Create(ctx, obj, metav1.CreateOptions{})
+		return err
+	case err != nil:
+		return err
+	}
+	if err = s.encode(obj, data); err != nil {
+		return err
+	}
+	_, err = s.resource().Update(ctx, obj, metav1.UpdateOptions{})
+	return err
+}
+
+func (s *store) objectKind() string {
+	if s.kind == SecretStore {
+		return "Secret"
+	}
+	return "ConfigMap"
+}
+
+func (s *store) decode(obj *unstructured.Unstructured) (map[string]string, error) {
+	data, _, err := unstructured.NestedStringMap(obj.Object, "data")
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		data = map[string]string{}
+	}
+	if s.kind != SecretStore {
+		return data, nil
+	}
+	for k, v := range data {
+		decoded, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("decoding key %s of secret %s/%s: %w", k, s.namespace, s.name, err)
+		}
+		data[k] = string(decoded)
+	}
+	return data, nil
+}
+
+func (s *store) encode(obj *unstructured.Unstructured, data map[string]string) error {
+	stored, _, err := unstructured.NestedStringMap(obj.Object, "data")
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		stored = map[string]string{}
+	}
+	for k, v := range data {
+		if s.kind == SecretStore {
+			v = base64.StdEncoding.EncodeToString([]byte(v))
+		}
+		stored[k] = v
+	}
+	return unstructured.SetNestedStringMap(obj.Object, stored, "data")
+}
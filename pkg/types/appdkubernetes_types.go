@@ -14,7 +14,14 @@ import (
 	"errors"
 	"github.com/open-telemetry/opentelemetry-operator/apis/v1alpha1"
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
 	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
 // KubernetesAPI is placeholder for the Kubernetes kind api
@@ -28,6 +35,9 @@ type KubernetesAPI struct {
 	PersistentVolume      *apiv1.PersistentVolume      `json:"persistentVolume,omitempty"`
 	PersistentVolumeClaim *apiv1.PersistentVolumeClaim `json:"persistentVolumeClaim,omitempty"`
 	ReplicationController *apiv1.ReplicationController `json:"replicationController,omitempty"`
+	ConfigMap             *apiv1.ConfigMap             `json:"configMap,omitempty"`
+	Secret                *apiv1.Secret                `json:"secret,omitempty"`
+	ServiceAccount        *apiv1.ServiceAccount        `json:"serviceAccount,omitempty"`
 }
 
 // KubernetesApps is placeholder for the Kubernetes Resource apps
@@ -38,9 +48,43 @@ type KubernetesApps struct {
 	StatefulSet *appsv1.StatefulSet `json:"statefulSet,omitempty"`
 }
 
+// KubernetesBatch is placeholder for the Kubernetes Resource batch
+type KubernetesBatch struct {
+	Job     *batchv1.Job     `json:"job,omitempty"`
+	CronJob *batchv1.CronJob `json:"cronJob,omitempty"`
+}
+
+// KubernetesNetworking is placeholder for the Kubernetes Resource networking.k8s.io
+type KubernetesNetworking struct {
+	Ingress       *networkingv1.Ingress       `json:"ingress,omitempty"`
+	NetworkPolicy *networkingv1.NetworkPolicy `json:"networkPolicy,omitempty"`
+}
+
+// KubernetesAutoscaling is placeholder for the Kubernetes Resource autoscaling
+type KubernetesAutoscaling struct {
+	// HorizontalPodAutoscaler is autoscaling/v2, served from Kubernetes 1.23 on
+	HorizontalPodAutoscaler *autoscalingv2.HorizontalPodAutoscaler `json:"horizontalPodAutoscaler,omitempty"`
+}
+
+// KubernetesPolicy is placeholder for the Kubernetes Resource policy
+type KubernetesPolicy struct {
+	PodDisruptionBudget *policyv1.PodDisruptionBudget `json:"podDisruptionBudget,omitempty"`
+}
+
+// KubernetesRBAC is placeholder for the Kubernetes Resource rbac.authorization.k8s.io
+type KubernetesRBAC struct {
+	Role               *rbacv1.Role               `json:"role,omitempty"`
+	RoleBinding        *rbacv1.RoleBinding        `json:"roleBinding,omitempty"`
+	ClusterRole        *rbacv1.ClusterRole        `json:"clusterRole,omitempty"`
+	ClusterRoleBinding *rbacv1.ClusterRoleBinding `json:"clusterRoleBinding,omitempty"`
+}
+
 // KubernetesCRD is placeholder for the Kubernetes Resource CRDS
 type KubernetesCRD struct {
+	// OpenTelemetryCollector uses the v1alpha1 schema, it is converted when
+	// applied as v1beta1
 	OpenTelemetryCollector *v1alpha1.OpenTelemetryCollector `json:"openTelemetryCollector,omitempty"`
+	Instrumentation        *v1alpha1.Instrumentation        `json:"instrumentation,omitempty"`
 }
 
 type Kind string
@@ -57,15 +101,43 @@ const (
 	PersistentVolumes      Kind = "persistentvolumes"
 	PersistentVolumeClaims Kind = "persistentvolumeclaims"
 	ReplicationControllers Kind = "replicationcontrollers"
+	ConfigMaps             Kind = "configmaps"
+	Secrets                Kind = "secrets"
+	ServiceAccounts        Kind = "serviceaccounts"
 
 	DaemonSets   Kind = "daemonsets"
 	ReplicaSets  Kind = "replicasets"
 	Deployments  Kind = "deployments"
 	StatefulSets Kind = "statefulsets"
 
+	Jobs     Kind = "jobs"
+	CronJobs Kind = "cronjobs"
+
+	Ingresses       Kind = "ingresses"
+	NetworkPolicies Kind = "networkpolicies"
+
+	HorizontalPodAutoscalers Kind = "horizontalpodautoscalers"
+	PodDisruptionBudgets     Kind = "poddisruptionbudgets"
+
+	Roles               Kind = "roles"
+	RoleBindings        Kind = "rolebindings"
+	ClusterRoles        Kind = "clusterroles"
+	ClusterRoleBindings Kind = "clusterrolebindings"
+
 	OpenTelemetryCollectors Kind = "opentelemetrycollectors"
+	Instrumentations        Kind = "instrumentations"
 )
 
+// ClusterScoped reports whether objects of the kind live outside namespaces
+func (k Kind) ClusterScoped() bool {
+	switch k {
+	case Nodes, Namespaces, PersistentVolumes, ClusterRoles, ClusterRoleBindings:
+		return true
+	default:
+		return false
+	}
+}
+
 // GroupVersionResource unambiguously identifies a resource.  It doesn't anonymously include GroupVersion
 // to avoid automatic coercion.  It doesn't use a GroupVersion to avoid custom marshalling
 type GroupVersionResource struct {
@@ -74,6 +146,8 @@ type GroupVersionResource struct {
 	Resource Kind   `json:"resource"`
 }
 
+// Operation to perform on the resource, when not set the resource is created
+// or updated depending on whether it exists
 type Operation int
 
 const (
@@ -85,54 +159,133 @@ const (
 type OperationInfo struct {
 	Name      string    `json:"name"`
 	Operation Operation `json:"operation"`
+	// PropagationPolicy of the dependents on Delete: Foreground, Background or Orphan
+	PropagationPolicy *metav1.DeletionPropagation `json:"propagationPolicy,omitempty"`
+	// GracePeriodSeconds on Delete, the object's default is used when not set
+	GracePeriodSeconds *int64 `json:"gracePeriodSeconds,omitempty"`
 }
 
 type ResourceInfo struct {
 	OperationInfo        OperationInfo        `json:"operationInfo"`
 	GroupVersionResource GroupVersionResource `json:"groupVersionResource"`
+	// Namespace of the resource, defaults to the object metadata namespace and
+	// then to the agent namespace. Must be empty for cluster scoped kinds. The
+	// key is not "namespace", which holds the inlined Namespace object.
+	Namespace string `json:"targetNamespace,omitempty"`
 }
 
 // AppDKubernetes placeholder for different types of resources such as api, apps, CRDS
 type AppDKubernetes struct {
-	ResourceInfo    `json:",inline"`
-	*KubernetesAPI  `json:",inline,omitempty"`
-	*KubernetesApps `json:",inline,omitempty"`
-	*KubernetesCRD  `json:",inline,omitempty"`
+	ResourceInfo           `json:",inline"`
+	*KubernetesAPI         `json:",inline,omitempty"`
+	*KubernetesApps        `json:",inline,omitempty"`
+	*KubernetesBatch       `json:",inline,omitempty"`
+	*KubernetesNetworking  `json:",inline,omitempty"`
+	*KubernetesAutoscaling `json:",inline,omitempty"`
+	*KubernetesPolicy      `json:",inline,omitempty"`
+	*KubernetesRBAC        `json:",inline,omitempty"`
+	*KubernetesCRD         `json:",inline,omitempty"`
+	// Manifest is an arbitrary object identified by its apiVersion and kind, its
+	// resource and scope are resolved through API discovery
+	Manifest *unstructured.Unstructured `json:"manifest,omitempty"`
 }
 
 // MarshalResourceJSON to convert resource object to Json
 func (a *AppDKubernetes) MarshalResourceJSON() ([]byte, error) {
+	if a.Manifest != nil {
+		return a.Manifest.MarshalJSON()
+	}
+	// A delete may omit the object, which then marshals as null
+	api, apps, rbac, crd := a.KubernetesAPI, a.KubernetesApps, a.KubernetesRBAC, a.KubernetesCRD
+	batch, networking, autoscaling, policy := a.KubernetesBatch, a.KubernetesNetworking, a.KubernetesAutoscaling,
+		a.KubernetesPolicy
+	if api == nil {
+		api = &KubernetesAPI{}
+	}
+	if apps == nil {
+		apps = &KubernetesApps{}
+	}
+	if batch == nil {
+		batch = &KubernetesBatch{}
+	}
+	if networking == nil {
+		networking = &KubernetesNetworking{}
+	}
+	if autoscaling == nil {
+		autoscaling = &KubernetesAutoscaling{}
+	}
+	if policy == nil {
+		policy = &KubernetesPolicy{}
+	}
+	if rbac == nil {
+		rbac = &KubernetesRBAC{}
+	}
+	if crd == nil {
+		crd = &KubernetesCRD{}
+	}
 	switch a.ResourceInfo.GroupVersionResource.Resource {
 	case Pods:
-		return json.Marshal(a.KubernetesAPI.Pod)
+		return json.Marshal(api.Pod)
 	case Nodes:
-		return json.Marshal(a.KubernetesAPI.Node)
+		return json.Marshal(api.Node)
 	case Services:
-		return json.Marshal(a.KubernetesAPI.Service)
+		return json.Marshal(api.Service)
 	case Namespaces:
-		return json.Marshal(a.KubernetesAPI.Namespace)
+		return json.Marshal(api.Namespace)
 	case LimitRanges:
-		return json.Marshal(a.KubernetesAPI.LimitRange)
+		return json.Marshal(api.LimitRange)
 	case ResourceQuotas:
-		return json.Marshal(a.KubernetesAPI.ResourceQuota)
+		return json.Marshal(api.ResourceQuota)
 	case PersistentVolumes:
-		return json.Marshal(a.KubernetesAPI.PersistentVolume)
+		return json.Marshal(api.PersistentVolume)
 	case PersistentVolumeClaims:
-		return json.Marshal(a.KubernetesAPI.PersistentVolumeClaim)
+		return json.Marshal(api.PersistentVolumeClaim)
 	case ReplicationControllers:
-		return json.Marshal(a.KubernetesAPI.ReplicationController)
+		return json.Marshal(api.ReplicationController)
+	case ConfigMaps:
+		return json.Marshal(api.ConfigMap)
+	case Secrets:
+		return json.Marshal(api.Secret)
+	case ServiceAccounts:
+		return json.Marshal(api.ServiceAccount)
 
 	case DaemonSets:
-		return json.Marshal(a.KubernetesApps.DaemonSet)
+		return json.Marshal(apps.DaemonSet)
 	case ReplicaSets:
-		return json.Marshal(a.KubernetesApps.ReplicaSet)
+		return json.Marshal(apps.ReplicaSet)
 	case StatefulSets:
-		return json.Marshal(a.KubernetesApps.StatefulSet)
+		return json.Marshal(apps.StatefulSet)
 	case Deployments:
-		return json.Marshal(a.KubernetesApps.Deployment)
+		return json.Marshal(apps.Deployment)
+
+	case Jobs:
+		return json.Marshal(batch.Job)
+	case CronJobs:
+		return json.Marshal(batch.CronJob)
+
+	case Ingresses:
+		return json.Marshal(networking.Ingress)
+	case NetworkPolicies:
+		return json.Marshal(networking.NetworkPolicy)
+
+	case HorizontalPodAutoscalers:
+		return json.Marshal(autoscaling.HorizontalPodAutoscaler)
+	case PodDisruptionBudgets:
+		return json.Marshal(policy.PodDisruptionBudget)
+
+	case Roles:
+		return json.Marshal(rbac.Role)
+	case RoleBindings:
+		return json.Marshal(rbac.RoleBinding)
+	case ClusterRoles:
+		return json.Marshal(rbac.ClusterRole)
+	case ClusterRoleBindings:
+		return json.Marshal(rbac.ClusterRoleBinding)
 
 	case OpenTelemetryCollectors:
-		return json.Marshal(a.KubernetesCRD.OpenTelemetryCollector)
+		return json.Marshal(crd.OpenTelemetryCollector)
+	case Instrumentations:
+		return json.Marshal(crd.Instrumentation)
 
 	default:
 		return nil, errors.New("un-know resource type")
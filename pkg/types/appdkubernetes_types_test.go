@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package types
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAppDKubernetesUnmarshal(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    string
+		namespace  string
+		deployment string
+		nsObject   string
+	}{
+		{
+			name: "namespaced object with target namespace",
+			payload: `{"operationInfo":{"name":"app","operation":1},"targetNamespace":"apps",
+				"groupVersionResource":{"group":"apps","version":"v1","resource":"deployments"},
+				"deployment":{"metadata":{"name":"app"}}}`,
+			namespace:  "apps",
+			deployment: "app",
+		},
+		{
+			name: "namespace object",
+			payload: `{"operationInfo":{"name":"apps"},
+				"groupVersionResource":{"group":"","version":"v1","resource":"namespaces"},
+				"namespace":{"metadata":{"name":"apps"}}}`,
+			nsObject: "apps",
+		},
+		{
+			name: "target namespace next to a namespace object",
+			payload: `{"operationInfo":{"name":"apps"},"targetNamespace":"other",
+				"groupVersionResource":{"group":"","version":"v1","resource":"namespaces"},
+				"namespace":{"metadata":{"name":"apps"}}}`,
+			namespace: "other",
+			nsObject:  "apps",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var a AppDKubernetes
+			if err := json.Unmarshal([]byte(tt.payload), &a); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if a.ResourceInfo.Namespace != tt.namespace {
+				t.Errorf("ResourceInfo.Namespace = %q, want %q", a.ResourceInfo.Namespace, tt.namespace)
+			}
+			if tt.deployment != "" && (a.KubernetesApps == nil || a.KubernetesApps.Deployment == nil ||
+				a.KubernetesApps.Deployment.Name != tt.deployment) {
+				t.Errorf("deployment %q not decoded", tt.deployment)
+			}
+			if tt.nsObject != "" && (a.KubernetesAPI == nil || a.KubernetesAPI.Namespace == nil ||
+				a.KubernetesAPI.Namespace.Name != tt.nsObject) {
+				t.Errorf("namespace object %q not decoded", tt.nsObject)
+			}
+		})
+	}
+}
+
+func TestAppDKubernetesRoundTrip(t *testing.T) {
+	payload := `{"operationInfo":{"name":"apps","operation":2},"targetNamespace":"other",
+		"groupVersionResource":{"group":"","version":"v1","resource":"namespaces"},
+		"namespace":{"metadata":{"name":"apps","labels":{"team":"a"}}}}`
+	var first AppDKubernetes
+	if err := json.Unmarshal([]byte(payload), &first); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	data, err := json.Marshal(&first)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	var second AppDKubernetes
+	if err := json.Unmarshal(data, &second); err != nil {
+		t.Fatalf("Unmarshal() of %s error = %v", data, err)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("round trip through %s changed the payload:\n got %+v\nwant %+v", data, second, first)
+	}
+	if second.KubernetesAPI == nil || second.KubernetesAPI.Namespace == nil {
+		t.Fatalf("round trip through %s lost the namespace object", data)
+	}
+}
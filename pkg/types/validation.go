@@ -0,0 +1,335 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package types
+
+import (
+	"fmt"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sort"
+	"strings"
+)
+
+// FieldError is a single invalid field of a payload
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// ValidationError holds every invalid field of a payload
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, fe := range e {
+		messages = append(messages, fe.Field+": "+fe.Message)
+	}
+	return "invalid resource: " + strings.Join(messages, "; ")
+}
+
+// kindField is the API group serving a known kind, the field holding it and
+// the versions the field can be applied as, any version when empty
+type kindField struct {
+	group    string
+	field    string
+	versions []string
+}
+
+var kindFields = map[Kind]kindField{
+	Pods:                   {"", "pod", nil},
+	Nodes:                  {"", "node", nil},
+	Services:               {"", "service", nil},
+	Namespaces:             {"", "namespace", nil},
+	LimitRanges:            {"", "limitRange", nil},
+	ResourceQuotas:         {"", "resourceQuota", nil},
+	PersistentVolumes:      {"", "persistentVolume", nil},
+	PersistentVolumeClaims: {"", "persistentVolumeClaim", nil},
+	ReplicationControllers: {"", "replicationController", nil},
+	ConfigMaps:             {"", "configMap", nil},
+	Secrets:                {"", "secret", nil},
+	ServiceAccounts:        {"", "serviceAccount", nil},
+
+	DaemonSets:   {"apps", "daemonSet", nil},
+	ReplicaSets:  {"apps", "replicaSet", nil},
+	Deployments:  {"apps", "deployment", nil},
+	StatefulSets: {"apps", "statefulSet", nil},
+
+	Jobs:     {batchv1.GroupName, "job", nil},
+	CronJobs: {batchv1.GroupName, "cronJob", nil},
+
+	Ingresses:       {networkingv1.GroupName, "ingress", nil},
+	NetworkPolicies: {networkingv1.GroupName, "networkPolicy", nil},
+
+	HorizontalPodAutoscalers: {autoscalingv2.GroupName, "horizontalPodAutoscaler", nil},
+	PodDisruptionBudgets:     {policyv1.GroupName, "podDisruptionBudget", nil},
+
+	Roles:               {rbacv1.GroupName, "role", nil},
+	RoleBindings:        {rbacv1.GroupName, "roleBinding", nil},
+	ClusterRoles:        {rbacv1.GroupName, "clusterRole", nil},
+	ClusterRoleBindings: {rbacv1.GroupName, "clusterRoleBinding", nil},
+
+	OpenTelemetryCollectors: {"opentelemetry.io", "openTelemetryCollector", []string{"v1alpha1", "v1beta1"}},
+	Instrumentations:        {"opentelemetry.io", "instrumentation", []string{"v1alpha1"}},
+}
+
+// objects returns the populated typed fields keyed by the kind they hold
+func (a *AppDKubernetes) objects() map[Kind]metav1.Object {
+	objects := make(map[Kind]metav1.Object)
+	if api := a.KubernetesAPI; api != nil {
+		if api.Pod != nil {
+			objects[Pods] = api.Pod
+		}
+		if api.Node != nil {
+			objects[Nodes] = api.Node
+		}
+		if api.Service != nil {
+			objects[Services] = api.Service
+		}
+		if api.Namespace != nil {
+			objects[Namespaces] = api.Namespace
+		}
+		if api.LimitRange != nil {
+			objects[LimitRanges] = api.LimitRange
+		}
+		if api.ResourceQuota != nil {
+			objects[ResourceQuotas] = api.ResourceQuota
+		}
+		if api.PersistentVolume != nil {
+			objects[PersistentVolumes] = api.PersistentVolume
+		}
+		if api.PersistentVolumeClaim != nil {
+			objects[PersistentVolumeClaims] = api.PersistentVolumeClaim
+		}
+		if api.ReplicationController != nil {
+			objects[ReplicationControllers] = api.ReplicationController
+		}
+		if api.ConfigMap != nil {
+			objects[ConfigMaps] = api.ConfigMap
+		}
+		if api.Secret != nil {
+			objects[Secrets] = api.Secret
+		}
+		if api.ServiceAccount != nil {
+			objects[ServiceAccounts] = api.ServiceAccount
+		}
+	}
+	if apps := a.KubernetesApps; apps != nil {
+		if apps.DaemonSet != nil {
+			objects[DaemonSets] = apps.DaemonSet
+		}
+		if apps.ReplicaSet != nil {
+			objects[ReplicaSets] = apps.ReplicaSet
+		}
+		if apps.Deployment != nil {
+			objects[Deployments] = apps.Deployment
+		}
+		if apps.StatefulSet != nil {
+			objects[StatefulSets] = apps.StatefulSet
+		}
+	}
+	if batch := a.KubernetesBatch; batch != nil {
+		if batch.Job != nil {
+			objects[Jobs] = batch.Job
+		}
+		if batch.CronJob != nil {
+			objects[CronJobs] = batch.CronJob
+		}
+	}
+	if networking := a.KubernetesNetworking; networking != nil {
+		if networking.Ingress != nil {
+			objects[Ingresses] = networking.Ingress
+		}
+		if networking.NetworkPolicy != nil {
+			objects[NetworkPolicies] = networking.NetworkPolicy
+		}
+	}
+	if autoscaling := a.KubernetesAutoscaling; autoscaling != nil {
+		if autoscaling.HorizontalPodAutoscaler != nil {
+			objects[HorizontalPodAutoscalers] = autoscaling.HorizontalPodAutoscaler
+		}
+	}
+	if policy := a.KubernetesPolicy; policy != nil {
+		if policy.PodDisruptionBudget != nil {
+			objects[PodDisruptionBudgets] = policy.PodDisruptionBudget
+		}
+	}
+	if rbac := a.KubernetesRBAC; rbac != nil {
+		if rbac.Role != nil {
+			objects[Roles] = rbac.Role
+		}
+		if rbac.RoleBinding != nil {
+			objects[RoleBindings] = rbac.RoleBinding
+		}
+		if rbac.ClusterRole != nil {
+			objects[ClusterRoles] = rbac.ClusterRole
+		}
+		if rbac.ClusterRoleBinding != nil {
+			objects[ClusterRoleBindings] = rbac.ClusterRoleBinding
+		}
+	}
+	if crd := a.KubernetesCRD; crd != nil {
+		if crd.OpenTelemetryCollector != nil {
+			objects[OpenTelemetryCollectors] = crd.OpenTelemetryCollector
+		}
+		if crd.Instrumentation != nil {
+			objects[Instrumentations] = crd.Instrumentation
+		}
+	}
+	return objects
+}
+
+// Default fills in the operation name from the object name, every operation
+// but a create needs it to find the object in the cluster
+func (a *AppDKubernetes) Default() {
+	info := &a.ResourceInfo.OperationInfo
+	if info.Name != "" {
+		return
+	}
+	if a.Manifest != nil {
+		info.Name = a.Manifest.GetName()
+		return
+	}
+	if obj, ok := a.objects()[a.ResourceInfo.GroupVersionResource.Resource]; ok {
+		info.Name = obj.GetName()
+	}
+}
+
+// Validate checks the payload before it is sent to the cluster: the resource
+// must match the populated field, the object name must match the operation
+// name and the operation options must fit the operation. Every invalid field
+// is reported in a single ValidationError.
+func (a *AppDKubernetes) Validate() error {
+	var errs ValidationError
+	add := func(field, format string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	info := a.ResourceInfo.OperationInfo
+	gvr := a.ResourceInfo.GroupVersionResource
+	switch info.Operation {
+	case 0, Create, Update, Delete:
+	default:
+		add("operationInfo.operation", "%d is not one of %d (create), %d (update) or %d (delete)",
+			info.Operation, Create, Update, Delete)
+	}
+	if info.Operation != Delete {
+		if info.PropagationPolicy != nil {
+			add("operationInfo.propagationPolicy", "only allowed with the delete operation")
+		}
+		if info.GracePeriodSeconds != nil {
+			add("operationInfo.gracePeriodSeconds", "only allowed with the delete operation")
+		}
+	}
+	if p := info.PropagationPolicy; p != nil {
+		switch *p {
+		case metav1.DeletePropagationForeground, metav1.DeletePropagationBackground, metav1.DeletePropagationOrphan:
+		default:
+			add("operationInfo.propagationPolicy", "%q is not one of Foreground, Background or Orphan", *p)
+		}
+	}
+	if g := info.GracePeriodSeconds; g != nil && *g < 0 {
+		add("operationInfo.gracePeriodSeconds", "must not be negative")
+	}
+
+	objects := a.objects()
+	var name, generateName string
+	if a.Manifest != nil {
+		for _, field := range populatedFields(objects, "") {
+			add(field, "not allowed together with manifest")
+		}
+		if a.Manifest.GetAPIVersion() == "" {
+			add("manifest.apiVersion", "required")
+		}
+		if a.Manifest.GetKind() == "" {
+			add("manifest.kind", "required")
+		}
+		name, generateName = a.Manifest.GetName(), a.Manifest.GetGenerateName()
+	} else {
+		expected, known := kindFields[gvr.Resource]
+		switch {
+		case gvr.Resource == "":
+			add("groupVersionResource.resource", "required unless a manifest is sent")
+		case !known:
+			add("groupVersionResource.resource", "%q is not a known kind, send it as a manifest", gvr.Resource)
+		default:
+			if gvr.Group != expected.group {
+				add("groupVersionResource.group", "%q does not serve %s, expected %q", gvr.Group, gvr.Resource, expected.group)
+			}
+			switch {
+			case gvr.Version == "":
+				add("groupVersionResource.version", "required")
+			case len(expected.versions) > 0 && !contains(expected.versions, gvr.Version):
+				add("groupVersionResource.version", "%q is not supported for %s, use one of %s", gvr.Version,
+					gvr.Resource, strings.Join(expected.versions, ", "))
+			}
+		}
+		for _, field := range populatedFields(objects, gvr.Resource) {
+			add(field, "set but the resource is %q", gvr.Resource)
+		}
+		obj, ok := objects[gvr.Resource]
+		switch {
+		case ok:
+			name, generateName = obj.GetName(), obj.GetGenerateName()
+		case known && info.Operation != Delete:
+			add(expected.field, "required for resource %q", gvr.Resource)
+		}
+	}
+
+	switch {
+	case name != "" && info.Name != "" && name != info.Name:
+		add("metadata.name", "%q does not match operationInfo.name %q", name, info.Name)
+	case name == "" && info.Name == "" && generateName == "":
+		add("operationInfo.name", "required when the object has no name")
+	case name == "" && info.Name == "" && info.Operation != Create:
+		// Only a create can let the API server generate the name
+		add("operationInfo.name", "required unless the operation is %d (create), generateName is only used by a create", Create)
+	}
+	if a.ResourceInfo.Namespace != "" && gvr.Resource.ClusterScoped() {
+		add("targetNamespace", "%s are cluster scoped", gvr.Resource)
+	}
+	// A cluster role binding has no namespace to default its service accounts to
+	if binding := objects[ClusterRoleBindings]; binding != nil && a.Manifest == nil {
+		for i, subject := range binding.(*rbacv1.ClusterRoleBinding).Subjects {
+			if subject.Kind == rbacv1.ServiceAccountKind && subject.Namespace == "" {
+				add(fmt.Sprintf("clusterRoleBinding.subjects[%d].namespace", i), "required for service accounts")
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// populatedFields lists the fields of the populated kinds other than except
+func populatedFields(objects map[Kind]metav1.Object, except Kind) []string {
+	var fields []string
+	for kind := range objects {
+		if kind != except {
+			fields = append(fields, kindFields[kind].field)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
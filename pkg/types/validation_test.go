@@ -0,0 +1,268 @@
+/*
+ * Copyright (c) AppDynamics, Inc., and its affiliates 2020
+ * All Rights Reserved.
+ * THIS IS UNPUBLISHED PROPRIETARY CODE OF APPDYNAMICS, INC.
+ *
+ * The copyright notice above does not evidence any actual or
+ * intended publication of such source code
+ */
+
+package types
+
+import (
+	apiv1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"strings"
+	"testing"
+)
+
+func service(info OperationInfo, meta metav1.ObjectMeta) *AppDKubernetes {
+	return &AppDKubernetes{
+		ResourceInfo: ResourceInfo{
+			OperationInfo:        info,
+			GroupVersionResource: GroupVersionResource{Version: "v1", Resource: Services},
+		},
+		KubernetesAPI: &KubernetesAPI{Service: &apiv1.Service{ObjectMeta: meta}},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	orphan := metav1.DeletePropagationOrphan
+	unknownPolicy := metav1.DeletionPropagation("Later")
+	negative := int64(-1)
+
+	tests := []struct {
+		name    string
+		payload *AppDKubernetes
+		wantErr []string
+	}{
+		{
+			name:    "valid service",
+			payload: service(OperationInfo{Name: "app"}, metav1.ObjectMeta{Name: "app"}),
+		},
+		{
+			name:    "name from the operation",
+			payload: service(OperationInfo{Name: "app", Operation: Update}, metav1.ObjectMeta{}),
+		},
+		{
+			name:    "names do not match",
+			payload: service(OperationInfo{Name: "app"}, metav1.ObjectMeta{Name: "other"}),
+			wantErr: []string{`metadata.name: "other" does not match operationInfo.name "app"`},
+		},
+		{
+			name:    "no name",
+			payload: service(OperationInfo{}, metav1.ObjectMeta{}),
+			wantErr: []string{"operationInfo.name: required when the object has no name"},
+		},
+		{
+			name:    "generateName on create",
+			payload: service(OperationInfo{Operation: Create}, metav1.ObjectMeta{GenerateName: "app-"}),
+		},
+		{
+			name:    "generateName without an operation",
+			payload: service(OperationInfo{}, metav1.ObjectMeta{GenerateName: "app-"}),
+			wantErr: []string{"operationInfo.name: required unless the operation is 1 (create)"},
+		},
+		{
+			name:    "generateName on update",
+			payload: service(OperationInfo{Operation: Update}, metav1.ObjectMeta{GenerateName: "app-"}),
+			wantErr: []string{"operationInfo.name: required unless the operation is 1 (create)"},
+		},
+		{
+			name:    "unknown operation",
+			payload: service(OperationInfo{Name: "app", Operation: 7}, metav1.ObjectMeta{}),
+			wantErr: []string{"operationInfo.operation: 7 is not one of"},
+		},
+		{
+			name: "delete options without delete",
+			payload: service(OperationInfo{Name: "app", PropagationPolicy: &orphan, GracePeriodSeconds: &negative},
+				metav1.ObjectMeta{}),
+			wantErr: []string{
+				"operationInfo.propagationPolicy: only allowed with the delete operation",
+				"operationInfo.gracePeriodSeconds: only allowed with the delete operation",
+				"operationInfo.gracePeriodSeconds: must not be negative",
+			},
+		},
+		{
+			name:    "unknown propagation policy",
+			payload: service(OperationInfo{Name: "app", Operation: Delete, PropagationPolicy: &unknownPolicy}, metav1.ObjectMeta{}),
+			wantErr: []string{`operationInfo.propagationPolicy: "Later" is not one of`},
+		},
+		{
+			name: "delete without the object",
+			payload: &AppDKubernetes{ResourceInfo: ResourceInfo{
+				OperationInfo:        OperationInfo{Name: "app", Operation: Delete},
+				GroupVersionResource: GroupVersionResource{Version: "v1", Resource: Services},
+			}},
+		},
+		{
+			name: "missing object",
+			payload: &AppDKubernetes{ResourceInfo: ResourceInfo{
+				OperationInfo:        OperationInfo{Name: "app"},
+				GroupVersionResource: GroupVersionResource{Version: "v1", Resource: Services},
+			}},
+			wantErr: []string{`service: required for resource "services"`},
+		},
+		{
+			name: "wrong group and field",
+			payload: &AppDKubernetes{
+				ResourceInfo: ResourceInfo{
+					OperationInfo:        OperationInfo{Name: "app"},
+					GroupVersionResource: GroupVersionResource{Group: "apps", Version: "v1", Resource: Services},
+				},
+				KubernetesAPI: &KubernetesAPI{
+					Service: &apiv1.Service{},
+					Pod:     &apiv1.Pod{},
+				},
+			},
+			wantErr: []string{
+				`groupVersionResource.group: "apps" does not serve services, expected ""`,
+				`pod: set but the resource is "services"`,
+			},
+		},
+		{
+			name: "unknown kind",
+			payload: &AppDKubernetes{ResourceInfo: ResourceInfo{
+				OperationInfo:        OperationInfo{Name: "app"},
+				GroupVersionResource: GroupVersionResource{Version: "v1", Resource: "widgets"},
+			}},
+			wantErr: []string{`groupVersionResource.resource: "widgets" is not a known kind`},
+		},
+		{
+			name: "unsupported collector version",
+			payload: &AppDKubernetes{ResourceInfo: ResourceInfo{
+				OperationInfo: OperationInfo{Name: "otel", Operation: Delete},
+				GroupVersionResource: GroupVersionResource{Group: "opentelemetry.io", Version: "v2",
+					Resource: OpenTelemetryCollectors},
+			}},
+			wantErr: []string{`groupVersionResource.version: "v2" is not supported for opentelemetrycollectors`},
+		},
+		{
+			name: "target namespace of a cluster scoped kind",
+			payload: &AppDKubernetes{
+				ResourceInfo: ResourceInfo{
+					OperationInfo:        OperationInfo{Name: "apps"},
+					GroupVersionResource: GroupVersionResource{Version: "v1", Resource: Namespaces},
+					Namespace:            "other",
+				},
+				KubernetesAPI: &KubernetesAPI{Namespace: &apiv1.Namespace{}},
+			},
+			wantErr: []string{"targetNamespace: namespaces are cluster scoped"},
+		},
+		{
+			name: "config map next to a secret",
+			payload: &AppDKubernetes{
+				ResourceInfo: ResourceInfo{
+					OperationInfo:        OperationInfo{Name: "app"},
+					GroupVersionResource: GroupVersionResource{Version: "v1", Resource: ConfigMaps},
+				},
+				KubernetesAPI: &KubernetesAPI{ConfigMap: &apiv1.ConfigMap{}, Secret: &apiv1.Secret{}},
+			},
+			wantErr: []string{`secret: set but the resource is "configmaps"`},
+		},
+		{
+			name: "cluster role binding subject without namespace",
+			payload: &AppDKubernetes{
+				ResourceInfo: ResourceInfo{
+					OperationInfo: OperationInfo{Name: "read"},
+					GroupVersionResource: GroupVersionResource{Group: rbacv1.GroupName, Version: "v1",
+						Resource: ClusterRoleBindings},
+				},
+				KubernetesRBAC: &KubernetesRBAC{ClusterRoleBinding: &rbacv1.ClusterRoleBinding{
+					Subjects: []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: "agent"}},
+				}},
+			},
+			wantErr: []string{"clusterRoleBinding.subjects[0].namespace: required for service accounts"},
+		},
+		{
+			name: "manifest",
+			payload: &AppDKubernetes{
+				ResourceInfo: ResourceInfo{OperationInfo: OperationInfo{Name: "w"}},
+				Manifest: &unstructured.Unstructured{Object: map[string]interface{}{
+					"apiVersion": "example.com/v1", "kind": "Widget", "metadata": map[string]interface{}{"name": "w"},
+				}},
+			},
+		},
+		{
+			name: "manifest without kind next to a typed object",
+			payload: &AppDKubernetes{
+				ResourceInfo:  ResourceInfo{OperationInfo: OperationInfo{Name: "w"}},
+				KubernetesAPI: &KubernetesAPI{Service: &apiv1.Service{}},
+				Manifest:      &unstructured.Unstructured{Object: map[string]interface{}{"apiVersion": "v1"}},
+			},
+			wantErr: []string{"service: not allowed together with manifest", "manifest.kind: required"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.payload.Validate()
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() error = %v, want none", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() error = nil, want %q", tt.wantErr)
+			}
+			if _, ok := err.(ValidationError); !ok {
+				t.Errorf("Validate() error is %T, want ValidationError", err)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate() error = %q, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDefault(t *testing.T) {
+	manifest := &unstructured.Unstructured{}
+	manifest.SetAPIVersion("example.com/v1")
+	manifest.SetKind("Widget")
+	manifest.SetName("widget")
+
+	tests := []struct {
+		name    string
+		payload *AppDKubernetes
+		want    string
+	}{
+		{
+			name:    "name from the object",
+			payload: service(OperationInfo{Operation: Update}, metav1.ObjectMeta{Name: "app"}),
+			want:    "app",
+		},
+		{
+			name:    "name from the manifest",
+			payload: &AppDKubernetes{ResourceInfo: ResourceInfo{OperationInfo: OperationInfo{Operation: Delete}}, Manifest: manifest},
+			want:    "widget",
+		},
+		{
+			name:    "operation name kept",
+			payload: service(OperationInfo{Name: "app"}, metav1.ObjectMeta{Name: "other"}),
+			want:    "app",
+		},
+		{
+			name:    "generated name",
+			payload: service(OperationInfo{Operation: Create}, metav1.ObjectMeta{GenerateName: "app-"}),
+		},
+		{
+			name: "delete without the object",
+			payload: &AppDKubernetes{ResourceInfo: ResourceInfo{
+				OperationInfo:        OperationInfo{Operation: Delete},
+				GroupVersionResource: GroupVersionResource{Version: "v1", Resource: Services},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.payload.Default()
+			if got := tt.payload.ResourceInfo.OperationInfo.Name; got != tt.want {
+				t.Errorf("Default() name = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}